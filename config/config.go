@@ -1,6 +1,7 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -50,7 +51,9 @@ func LoadFromPath(fPath string) (*ServerConfigFile, error) {
 	pfx, _ := strings.CutPrefix(path.Ext(fPath), ".")
 	switch pfx {
 	case "toml":
-		if err := toml.Unmarshal(fileBytes, config); err != nil {
+		// The unmarshaler interface is needed for fields like StringList, which accept either a string or a list
+		decoder := toml.NewDecoder(bytes.NewReader(fileBytes)).EnableUnmarshalerInterface()
+		if err := decoder.Decode(config); err != nil {
 			err = errors.Join(fmt.Errorf("failed to unmarshal toml"), err)
 			return nil, err
 		}
@@ -68,5 +71,12 @@ func LoadFromPath(fPath string) (*ServerConfigFile, error) {
 		return nil, fmt.Errorf("unsupported file extension: %s", path.Ext(fPath))
 	}
 
+	if err := config.SetRecordDefaults(); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
 	return config, nil
 }
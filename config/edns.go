@@ -0,0 +1,37 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ednsOptionNames maps the names accepted in config to EDNS0 option codes
+var ednsOptionNames = map[string]uint16{
+	"llq":       dns.EDNS0LLQ,
+	"ul":        dns.EDNS0UL,
+	"nsid":      dns.EDNS0NSID,
+	"dau":       dns.EDNS0DAU,
+	"dhu":       dns.EDNS0DHU,
+	"n3u":       dns.EDNS0N3U,
+	"subnet":    dns.EDNS0SUBNET,
+	"expire":    dns.EDNS0EXPIRE,
+	"cookie":    dns.EDNS0COOKIE,
+	"keepalive": dns.EDNS0TCPKEEPALIVE,
+	"padding":   dns.EDNS0PADDING,
+	"ede":       dns.EDNS0EDE,
+}
+
+// ParseEDNSOption reads an EDNS0 option given either by name or by its numeric code
+func ParseEDNSOption(opt string) (uint16, error) {
+	if code, ok := ednsOptionNames[strings.ToLower(opt)]; ok {
+		return code, nil
+	}
+	code, err := strconv.ParseUint(opt, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown EDNS0 option %q", opt)
+	}
+	return uint16(code), nil
+}
@@ -1,16 +1,42 @@
 package config
 
+import "net/netip"
+
+// ApexKey is the reserved records key for the zone apex itself
+const ApexKey = "@"
+
+// RecordsCollection maps subdomain keys (relative to the zone name) to records. Use ApexKey for records on the zone
+// apex, and keys such as "*" or "*.dev" for wildcards.
 type RecordsCollection struct {
-	A     map[string][]ARecord     `validate:"dive,keys,lowercase,endkeys" yaml:"A" json:"A" toml:"A"`
-	AAAA  map[string][]AAAARecord  `validate:"dive,keys,lowercase,endkeys" yaml:"AAAA" json:"AAAA" toml:"AAAA"`
-	CNAME map[string][]CNAMERecord `validate:"dive,keys,lowercase,endkeys" yaml:"CNAME" json:"CNAME" toml:"CNAME"`
-	MX    map[string][]MXRecord    `validate:"dive,keys,lowercase,endkeys" yaml:"MX" json:"MX" toml:"MX"`
-	TXT   map[string][]TXTRecord   `validate:"dive,keys,lowercase,endkeys" yaml:"TXT" json:"TXT" yaml:"TXT"`
+	A     map[string][]ARecord     `validate:"dive,keys,lowercase,endkeys,dive" yaml:"A" json:"A" toml:"A"`
+	AAAA  map[string][]AAAARecord  `validate:"dive,keys,lowercase,endkeys,dive" yaml:"AAAA" json:"AAAA" toml:"AAAA"`
+	CNAME map[string][]CNAMERecord `validate:"dive,keys,lowercase,endkeys,dive" yaml:"CNAME" json:"CNAME" toml:"CNAME"`
+	MX    map[string][]MXRecord    `validate:"dive,keys,lowercase,endkeys,dive" yaml:"MX" json:"MX" toml:"MX"`
+	TXT   map[string][]TXTRecord   `validate:"dive,keys,lowercase,endkeys,dive" yaml:"TXT" json:"TXT" toml:"TXT"`
+	SRV   map[string][]SRVRecord   `validate:"dive,keys,lowercase,endkeys,dive" yaml:"SRV" json:"SRV" toml:"SRV"`
+	CAA   map[string][]CAARecord   `validate:"dive,keys,lowercase,endkeys,dive" yaml:"CAA" json:"CAA" toml:"CAA"`
+	PTR   map[string][]PTRRecord   `validate:"dive,keys,lowercase,endkeys,dive" yaml:"PTR" json:"PTR" toml:"PTR"`
+	NS    map[string][]NSRecord    `validate:"dive,keys,lowercase,endkeys,dive" yaml:"NS" json:"NS" toml:"NS"`
+	SVCB  map[string][]SVCBRecord  `validate:"dive,keys,lowercase,endkeys,dive" yaml:"SVCB" json:"SVCB" toml:"SVCB"`
+	HTTPS map[string][]SVCBRecord  `validate:"dive,keys,lowercase,endkeys,dive" yaml:"HTTPS" json:"HTTPS" toml:"HTTPS"`
+	// ALIAS is a pseudo-record that is resolved at query time and served as A/AAAA records, so it can be used at the apex
+	ALIAS map[string][]ALIASRecord `validate:"dive,keys,lowercase,endkeys,dive" yaml:"ALIAS" json:"ALIAS" toml:"ALIAS"`
+	// SOA is only ever served at the zone apex, so there is at most one per zone
+	SOA *SOARecord `validate:"omitempty" yaml:"SOA" json:"SOA" toml:"SOA"`
 }
 
 type BaseRecord struct {
 	TTL     uint32 `validate:"gte=0" default:"3600" yaml:"ttl" json:"ttl" toml:"ttl"`
 	Comment string `yaml:"comment" json:"comment" toml:"comment"`
+	// Subnets limits the record to clients in these networks, going by their source address (or EDNS Client Subnet
+	// option, for the zone's trusted ECS clients). Records without subnets are served to everyone that no scoped record
+	// matches.
+	Subnets []netip.Prefix `yaml:"subnets" json:"subnets" toml:"subnets"`
+}
+
+// Scope returns the client subnets the record is limited to, if any
+func (br BaseRecord) Scope() []netip.Prefix {
+	return br.Subnets
 }
 
 type ARecord struct {
@@ -30,11 +56,79 @@ type CNAMERecord struct {
 
 type TXTRecord struct {
 	BaseRecord
-	Content string `validate:"required" yaml:"content" json:"content" toml:"content"`
+	Content string `validate:"required_without=Strings" yaml:"content" json:"content" toml:"content"`
+	// Strings are served as separate character-strings within one record (ie DNS-SD key=value pairs) instead of Content
+	Strings []string `validate:"dive,max=255" yaml:"strings" json:"strings" toml:"strings"`
 }
 
 type MXRecord struct {
 	BaseRecord
 	Target     string `validate:"required,fqdn|ip_addr" yaml:"target" json:"target" toml:"target"`
-	Preference uint8  `validate:"required,gte=0" yaml:"preference" json:"preference" toml:"preference"`
+	Preference uint8  `validate:"gte=0" yaml:"preference" json:"preference" toml:"preference"`
+}
+
+type SRVRecord struct {
+	BaseRecord
+	Target   string `validate:"required,fqdn" yaml:"target" json:"target" toml:"target"`
+	Port     uint16 `validate:"required,gt=0" yaml:"port" json:"port" toml:"port"`
+	Priority uint16 `validate:"gte=0" yaml:"priority" json:"priority" toml:"priority"`
+	Weight   uint16 `validate:"gte=0" yaml:"weight" json:"weight" toml:"weight"`
+}
+
+type CAARecord struct {
+	BaseRecord
+	Flag  uint8  `default:"0" validate:"gte=0" yaml:"flag" json:"flag" toml:"flag"`
+	Tag   string `default:"issue" validate:"required,oneof=issue issuewild iodef" yaml:"tag" json:"tag" toml:"tag"`
+	Value string `validate:"required" yaml:"value" json:"value" toml:"value"`
+}
+
+type PTRRecord struct {
+	BaseRecord
+	Target string `validate:"required,fqdn" yaml:"target" json:"target" toml:"target"`
+}
+
+type NSRecord struct {
+	BaseRecord
+	Target string `validate:"required,fqdn" yaml:"target" json:"target" toml:"target"`
+}
+
+// SVCBRecord is used for both SVCB and HTTPS records (RFC 9460)
+type SVCBRecord struct {
+	BaseRecord
+	// Priority 0 (the default) puts the record in alias mode, in which case no parameters may be set. Use 1 or higher for
+	// service mode.
+	Priority uint16 `validate:"gte=0" yaml:"priority" json:"priority" toml:"priority"`
+	// Target is the name of the alternative endpoint, with or without the trailing dot; "." means the owner name itself
+	Target   string   `default:"." validate:"required,fqdn|eq=." yaml:"target" json:"target" toml:"target"`
+	ALPN     []string `validate:"dive,required,max=255" yaml:"alpn" json:"alpn" toml:"alpn"`
+	Port     uint16   `validate:"gte=0" yaml:"port" json:"port" toml:"port"`
+	IPv4Hint []string `validate:"dive,ip4_addr" yaml:"ipv4hint" json:"ipv4hint" toml:"ipv4hint"`
+	IPv6Hint []string `validate:"dive,ip6_addr" yaml:"ipv6hint" json:"ipv6hint" toml:"ipv6hint"`
+	// ECH is the base64 encoded ECHConfigList
+	ECH string `validate:"omitempty,base64" yaml:"ech" json:"ech" toml:"ech"`
+}
+
+// HasParams reports whether any SvcParams are set on the record
+func (r *SVCBRecord) HasParams() bool {
+	return len(r.ALPN) > 0 || r.Port != 0 || len(r.IPv4Hint) > 0 || len(r.IPv6Hint) > 0 || r.ECH != ""
+}
+
+type ALIASRecord struct {
+	// TTL is the maximum TTL served; the TTLs of the resolved target records are used if they are lower
+	BaseRecord
+	Target string `validate:"required,fqdn" yaml:"target" json:"target" toml:"target"`
+}
+
+type SOARecord struct {
+	BaseRecord
+	// Ns is the primary nameserver for the zone (MNAME)
+	Ns string `validate:"required,fqdn" yaml:"ns" json:"ns" toml:"ns"`
+	// Mbox is the responsible party's mailbox in domain form, ie hostmaster.example.com. (RNAME)
+	Mbox    string `validate:"required,fqdn" yaml:"mbox" json:"mbox" toml:"mbox"`
+	Serial  uint32 `default:"1" validate:"gt=0" yaml:"serial" json:"serial" toml:"serial"`
+	Refresh uint32 `default:"7200" validate:"gt=0" yaml:"refresh" json:"refresh" toml:"refresh"`
+	Retry   uint32 `default:"3600" validate:"gt=0" yaml:"retry" json:"retry" toml:"retry"`
+	Expire  uint32 `default:"1209600" validate:"gt=0" yaml:"expire" json:"expire" toml:"expire"`
+	// MinTTL is used as the negative caching TTL (RFC 2308)
+	MinTTL uint32 `default:"3600" validate:"gt=0" yaml:"minTTL" json:"minTTL" toml:"minTTL"`
 }
@@ -4,27 +4,274 @@ import (
 	"errors"
 	"fmt"
 	"github.com/creasty/defaults"
+	"net/netip"
 )
 
 type ServerConfigFile struct {
 	DefaultForwardConfig *ForwardConfig `yaml:"defaultForwardConfig" json:"defaultForwardConfig" toml:"defaultForwardConfig"`
 	EnableTailscale      bool           `default:"false" yaml:"enableTailscale" json:"enableTailscale" toml:"enableTailscale"`
 	Port                 uint16         `default:"53" validate:"required,gt=0" yaml:"port" json:"port" toml:"port"`
-	Bind                 string         `default:"127.0.0.1" validate:"required,ip_addr|(alphanumeric,lowercase)" yaml:"bind" json:"bind" toml:"bind"`
 	Zones                []*ZoneConfig  `yaml:"zones" json:"zones" toml:"zones"`
+	// Views serve their own zones to the clients they match, checked in order. Clients that match no view are
+	// answered from Zones.
+	Views []*ViewConfig `yaml:"views" json:"views" toml:"views"`
+	// Bind is a list of IP addresses and/or interface names to listen on. A single string is also accepted.
+	Bind StringList `default:"[\"127.0.0.1\"]" validate:"min=1,dive,required" yaml:"bind" json:"bind" toml:"bind"`
+	// TLS holds the certificate shared by the encrypted transports. It is re-read when the config is reloaded.
+	TLS *TLSConfig `yaml:"tls" json:"tls" toml:"tls"`
+	DoT *DoTConfig `yaml:"dot" json:"dot" toml:"dot"`
+	DoH *DoHConfig `yaml:"doh" json:"doh" toml:"doh"`
+	DoQ *DoQConfig `yaml:"doq" json:"doq" toml:"doq"`
+	// Cache holds forwarded and recursive answers, shared by all zones. It is emptied when the config is reloaded.
+	Cache *CacheConfig `default:"{}" yaml:"cache" json:"cache" toml:"cache"`
+	// RateLimit applies to every query before it reaches a zone. Zones can set their own limits on top of it.
+	RateLimit *RateLimitConfig `yaml:"rateLimit" json:"rateLimit" toml:"rateLimit"`
+	// Filter blocks names on blocklists in every zone that forwards or recurses, unless the zone opts out
+	Filter *FilterConfig `yaml:"filter" json:"filter" toml:"filter"`
+}
+
+type TLSConfig struct {
+	CertFile string `validate:"required,file" yaml:"certFile" json:"certFile" toml:"certFile"`
+	KeyFile  string `validate:"required,file" yaml:"keyFile" json:"keyFile" toml:"keyFile"`
+}
+
+// DoTConfig enables DNS-over-TLS on the server-wide bind addresses
+type DoTConfig struct {
+	Enabled bool   `default:"false" yaml:"enabled" json:"enabled" toml:"enabled"`
+	Port    uint16 `default:"853" validate:"gt=0" yaml:"port" json:"port" toml:"port"`
+}
+
+// DoHConfig enables DNS-over-HTTPS on the server-wide bind addresses, served at /dns-query
+type DoHConfig struct {
+	Enabled bool   `default:"false" yaml:"enabled" json:"enabled" toml:"enabled"`
+	Port    uint16 `default:"443" validate:"gt=0" yaml:"port" json:"port" toml:"port"`
+	// PlainHTTP serves DoH without TLS, for running behind a reverse proxy that terminates it
+	PlainHTTP bool `default:"false" yaml:"plainHttp" json:"plainHttp" toml:"plainHttp"`
+	// TrustedProxies are the networks of the reverse proxies whose X-Forwarded-For header is used for the client address
+	// in plain HTTP mode. The header is ignored for requests from anywhere else.
+	TrustedProxies []netip.Prefix `yaml:"trustedProxies" json:"trustedProxies" toml:"trustedProxies"`
+}
+
+// DoQConfig enables DNS-over-QUIC on the server-wide bind addresses
+type DoQConfig struct {
+	Enabled bool   `default:"false" yaml:"enabled" json:"enabled" toml:"enabled"`
+	Port    uint16 `default:"853" validate:"gt=0" yaml:"port" json:"port" toml:"port"`
+}
+
+// CacheConfig controls the response cache in front of the forwarder and recursor. TTLs are in seconds.
+type CacheConfig struct {
+	Enabled bool `default:"true" yaml:"enabled" json:"enabled" toml:"enabled"`
+	// Size is the maximum number of cached responses, after which the least recently used ones are evicted
+	Size   int    `default:"10000" validate:"gt=0" yaml:"size" json:"size" toml:"size"`
+	MaxTTL uint32 `default:"86400" yaml:"maxTtl" json:"maxTtl" toml:"maxTtl"`
+	// MaxNegativeTTL caps how long NXDOMAIN and NODATA responses are cached for (RFC 2308)
+	MaxNegativeTTL uint32 `default:"3600" yaml:"maxNegativeTtl" json:"maxNegativeTtl" toml:"maxNegativeTtl"`
+}
+
+// Filter responses for blocked names
+const (
+	FilterNXDomain = "nxdomain"
+	// FilterNullIP answers A and AAAA queries with 0.0.0.0 and ::
+	FilterNullIP = "null_ip"
+	// FilterSinkhole answers A and AAAA queries with the configured sinkhole addresses
+	FilterSinkhole = "sinkhole"
+)
+
+// FilterConfig blocks queries for names found on blocklists, before they are forwarded or resolved recursively.
+// Lists can be in hosts format, AdGuard/ABP syntax (`||example.com^`, which also blocks subdomains, and `@@` exceptions)
+// or plain domain lists.
+type FilterConfig struct {
+	Enabled bool `default:"false" yaml:"enabled" json:"enabled" toml:"enabled"`
+	// Blocklists and Allowlists are local file paths or http(s) URLs. Names on an allowlist are never blocked.
+	Blocklists []string `validate:"dive,required" yaml:"blocklists" json:"blocklists" toml:"blocklists"`
+	Allowlists []string `validate:"dive,required" yaml:"allowlists" json:"allowlists" toml:"allowlists"`
+	// Block and Allow are rules given directly in the config, in any of the list formats
+	Block []string `yaml:"block" json:"block" toml:"block"`
+	Allow []string `yaml:"allow" json:"allow" toml:"allow"`
+	// Response is how blocked names are answered. See the Filter* constants.
+	Response     string `default:"nxdomain" validate:"oneof=nxdomain null_ip sinkhole" yaml:"response" json:"response" toml:"response"`
+	SinkholeIPv4 string `validate:"omitempty,ipv4" yaml:"sinkholeIpv4" json:"sinkholeIpv4" toml:"sinkholeIpv4"`
+	SinkholeIPv6 string `validate:"omitempty,ipv6" yaml:"sinkholeIpv6" json:"sinkholeIpv6" toml:"sinkholeIpv6"`
+	TTL          uint32 `default:"60" yaml:"ttl" json:"ttl" toml:"ttl"`
+	// RefreshInterval is how often the lists are loaded again, in seconds. Lists that fail to load keep their previous
+	// contents. 0 only loads them when the config is (re)loaded. It is a pointer so that an explicit 0 is not replaced
+	// by the default.
+	RefreshInterval *uint32 `default:"86400" yaml:"refreshInterval" json:"refreshInterval" toml:"refreshInterval"`
+}
+
+// RateLimitConfig limits the queries per second of each client network with a token bucket, and the number of
+// identical responses they get per second (response rate limiting, as in BIND). Only UDP queries are dropped or
+// slipped, since the source address of other transports cannot be spoofed; those are refused instead.
+type RateLimitConfig struct {
+	Enabled bool `default:"false" yaml:"enabled" json:"enabled" toml:"enabled"`
+	// QueriesPerSecond is the sustained rate allowed per client network, and Burst how many queries may be sent at once.
+	// 0 disables the query limit.
+	QueriesPerSecond uint32 `default:"0" yaml:"queriesPerSecond" json:"queriesPerSecond" toml:"queriesPerSecond"`
+	Burst            uint32 `default:"0" yaml:"burst" json:"burst" toml:"burst"`
+	// ResponsesPerSecond is how many identical responses a client network may get per second. 0 disables RRL.
+	ResponsesPerSecond uint32 `default:"0" yaml:"responsesPerSecond" json:"responsesPerSecond" toml:"responsesPerSecond"`
+	// Slip sends every nth rate-limited response as an empty truncated one, so real clients can retry over TCP. The
+	// others are dropped. 0 drops every rate-limited response, and 1 truncates all of them. It is a pointer so that an
+	// explicit 0 is not replaced by the default.
+	Slip *uint32 `default:"2" yaml:"slip" json:"slip" toml:"slip"`
+	// IPv4Prefix and IPv6Prefix group client addresses into the networks that share a limit
+	IPv4Prefix uint8 `default:"24" validate:"lte=32" yaml:"ipv4Prefix" json:"ipv4Prefix" toml:"ipv4Prefix"`
+	IPv6Prefix uint8 `default:"56" validate:"lte=128" yaml:"ipv6Prefix" json:"ipv6Prefix" toml:"ipv6Prefix"`
+	// Exempt clients are never rate limited
+	Exempt []netip.Prefix `yaml:"exempt" json:"exempt" toml:"exempt"`
 }
 
 type ZoneConfig struct {
-	Name             string               `yaml:"name" json:"name" toml:"name"`
+	Name             string               `validate:"required,zone_name" yaml:"name" json:"name" toml:"name"`
 	RecursionEnabled bool                 `default:"false" yaml:"recursionEnabled" json:"recursionEnabled" toml:"recursionEnabled"`
 	ForwardEnabled   bool                 `default:"true" yaml:"forwardEnabled" json:"forwardEnabled" toml:"forwardEnabled"`
 	ForwardConfig    *ForwardConfig       `yaml:"forwardConfig" json:"forwardConfig" toml:"forwardConfig"`
 	Records          *RecordsCollection   `yaml:"records" json:"records" toml:"records"`
 	Tailscale        *TailscaleZoneConfig `yaml:"tailscale" json:"tailscale" toml:"tailscale"`
+	// AutoPTR generates PTR records from every other zone's A/AAAA records and Tailscale machines. Only valid for zones
+	// under in-addr.arpa. or ip6.arpa.
+	AutoPTR bool `default:"false" yaml:"autoPtr" json:"autoPtr" toml:"autoPtr"`
+	// AutoHTTPS derives an HTTPS record for names that have static A/AAAA records but no explicit HTTPS record
+	AutoHTTPS *AutoHTTPSConfig `yaml:"autoHttps" json:"autoHttps" toml:"autoHttps"`
+	// Services are expanded into the PTR, SRV and TXT records needed to advertise them over unicast DNS-SD
+	Services []*ServiceConfig `validate:"dive,required" yaml:"services" json:"services" toml:"services"`
+	// Bind restricts the zone to answering on these IP addresses and/or interface names, instead of the server-wide ones
+	Bind StringList `validate:"omitempty,dive,required" yaml:"bind" json:"bind" toml:"bind"`
+	// NoCache opts the zone out of the shared response cache, so every forwarded or recursive query is sent upstream
+	NoCache bool `default:"false" yaml:"noCache" json:"noCache" toml:"noCache"`
+	// QueryACL restricts which clients may query the zone at all
+	QueryACL *ACLConfig `yaml:"queryAcl" json:"queryAcl" toml:"queryAcl"`
+	// RecursionACL restricts which clients may have queries forwarded or resolved recursively. Other clients are
+	// still answered from the zone's own data.
+	RecursionACL *ACLConfig `yaml:"recursionAcl" json:"recursionAcl" toml:"recursionAcl"`
+	// RateLimit sets limits for the zone, in addition to the server-wide query limit. Responses of the zone are
+	// limited by this instead of the server-wide RRL settings.
+	RateLimit *RateLimitConfig `yaml:"rateLimit" json:"rateLimit" toml:"rateLimit"`
+	// NoFilter opts the zone out of the server-wide blocklists
+	NoFilter bool `default:"false" yaml:"noFilter" json:"noFilter" toml:"noFilter"`
+	// TrustedECSClients are the clients (ie resolvers forwarding to Tungsten) whose EDNS Client Subnet option is used to
+	// pick subnet-scoped records. Everyone else is matched on their source address, since the option can be set to
+	// anything.
+	TrustedECSClients []netip.Prefix `yaml:"trustedEcsClients" json:"trustedEcsClients" toml:"trustedEcsClients"`
+}
+
+// ACLConfig matches clients by their source address. Denied networks take precedence, and if any networks are allowed
+// then clients outside of them are denied as well. Refused clients get a REFUSED response.
+type ACLConfig struct {
+	Allow []netip.Prefix `yaml:"allow" json:"allow" toml:"allow"`
+	Deny  []netip.Prefix `yaml:"deny" json:"deny" toml:"deny"`
+}
+
+// Allows reports whether the ACL lets a client through. A nil ACL allows everyone.
+func (acl *ACLConfig) Allows(addr netip.Addr) bool {
+	if acl == nil {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, prefix := range acl.Deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(acl.Allow) == 0 {
+		return true
+	}
+	for _, prefix := range acl.Allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ViewConfig is a split-horizon view: a set of zones only served to the clients it matches. A query matches the view
+// if it comes from one of the client networks, or arrives on one of the listeners.
+type ViewConfig struct {
+	Name    string         `validate:"required" yaml:"name" json:"name" toml:"name"`
+	Clients []netip.Prefix `yaml:"clients" json:"clients" toml:"clients"`
+	// Listeners are IP addresses and/or interface names, like Bind. They are listened on in addition to the
+	// server-wide bind addresses, which should not be wildcards since the view is matched on the exact local address.
+	Listeners StringList    `validate:"omitempty,dive,required" yaml:"listeners" json:"listeners" toml:"listeners"`
+	Zones     []*ZoneConfig `yaml:"zones" json:"zones" toml:"zones"`
 }
 
 type ForwardConfig struct {
-	Addresses []*string `validate:"min=1,ip_addr" yaml:"addresses" json:"addresses" toml:"addresses"`
+	// Addresses are the upstream servers, as bare IPs or udp://, tcp://, tls:// or https:// URLs. See ParseUpstream.
+	Addresses []*string `validate:"min=1,dive,required,upstream" yaml:"addresses" json:"addresses" toml:"addresses"`
+	// ServeStale and Prefetch only take effect when the response cache is enabled for the zone
+	ServeStale *ServeStaleConfig `yaml:"serveStale" json:"serveStale" toml:"serveStale"`
+	Prefetch   *PrefetchConfig   `yaml:"prefetch" json:"prefetch" toml:"prefetch"`
+	// Strategy decides which upstream is asked first. See the Strategy* constants.
+	Strategy string `default:"round_robin" validate:"oneof=round_robin random sequential lowest_latency parallel" yaml:"strategy" json:"strategy" toml:"strategy"`
+	// MaxFailures is how many queries in a row an upstream may fail before it is ejected for EjectTime seconds. Ejected
+	// upstreams are only tried once every healthy one has failed.
+	MaxFailures uint32             `default:"3" validate:"gt=0" yaml:"maxFailures" json:"maxFailures" toml:"maxFailures"`
+	EjectTime   uint32             `default:"30" validate:"gt=0" yaml:"ejectTime" json:"ejectTime" toml:"ejectTime"`
+	HealthCheck *HealthCheckConfig `yaml:"healthCheck" json:"healthCheck" toml:"healthCheck"`
+	// EDNSOptions lists the client EDNS0 options passed on to upstreams, by name (ie "cookie") or option code. The
+	// buffer size and DO bit are always passed on.
+	EDNSOptions []string   `default:"[\"nsid\",\"cookie\",\"padding\"]" validate:"dive,edns_option" yaml:"ednsOptions" json:"ednsOptions" toml:"ednsOptions"`
+	ECS         *ECSConfig `yaml:"ecs" json:"ecs" toml:"ecs"`
+}
+
+// EDNS Client Subnet modes
+const (
+	// ECSStrip never sends a client subnet upstream
+	ECSStrip = "strip"
+	// ECSPass forwards the subnet given by the client, if any
+	ECSPass = "pass"
+	// ECSSynthesize forwards the client's subnet, or creates one from its address if it is publicly routable
+	ECSSynthesize = "synthesize"
+)
+
+// ECSConfig controls the EDNS Client Subnet option (RFC 7871) sent to upstreams
+type ECSConfig struct {
+	Mode string `default:"strip" validate:"oneof=strip pass synthesize" yaml:"mode" json:"mode" toml:"mode"`
+	// IPv4Prefix and IPv6Prefix are the prefix lengths of synthesized subnets. Subnets passed on from clients are
+	// shortened to them as well, so no more of the client address is revealed than configured.
+	IPv4Prefix uint8 `default:"24" validate:"lte=32" yaml:"ipv4Prefix" json:"ipv4Prefix" toml:"ipv4Prefix"`
+	IPv6Prefix uint8 `default:"56" validate:"lte=128" yaml:"ipv6Prefix" json:"ipv6Prefix" toml:"ipv6Prefix"`
+}
+
+// Upstream selection strategies
+const (
+	// StrategyRoundRobin spreads queries evenly across upstreams
+	StrategyRoundRobin = "round_robin"
+	StrategyRandom     = "random"
+	// StrategySequential always asks upstreams in the configured order, falling back to the next one on failure
+	StrategySequential = "sequential"
+	// StrategyLowestLatency prefers the upstream with the lowest moving average RTT
+	StrategyLowestLatency = "lowest_latency"
+	// StrategyParallel asks every healthy upstream at once and uses the first answer
+	StrategyParallel = "parallel"
+)
+
+// HealthCheckConfig actively probes upstreams in the background, so failing ones are ejected (and recovered ones
+// brought back) without waiting for client queries to time out
+type HealthCheckConfig struct {
+	Enabled bool `default:"false" yaml:"enabled" json:"enabled" toml:"enabled"`
+	// Interval between probes, in seconds
+	Interval uint32 `default:"10" validate:"gt=0" yaml:"interval" json:"interval" toml:"interval"`
+	// Name is queried for NS records to probe each upstream
+	Name string `default:"." yaml:"name" json:"name" toml:"name"`
+}
+
+// ServeStaleConfig keeps forwarded responses past their expiry, to answer with when every upstream fails (RFC 8767)
+type ServeStaleConfig struct {
+	Enabled bool `default:"false" yaml:"enabled" json:"enabled" toml:"enabled"`
+	// MaxAge is how long past expiry a response may still be served, in seconds
+	MaxAge uint32 `default:"86400" validate:"gt=0" yaml:"maxAge" json:"maxAge" toml:"maxAge"`
+	// TTL is given to the records of stale responses, in seconds
+	TTL uint32 `default:"30" validate:"gt=0" yaml:"ttl" json:"ttl" toml:"ttl"`
+}
+
+// PrefetchConfig refreshes popular cached responses in the background shortly before they expire
+type PrefetchConfig struct {
+	Enabled bool `default:"false" yaml:"enabled" json:"enabled" toml:"enabled"`
+	// MinHits is how many times a response must be served from the cache before it is worth prefetching
+	MinHits uint32 `default:"3" validate:"gt=0" yaml:"minHits" json:"minHits" toml:"minHits"`
+	// Threshold is the percentage of the original TTL left at which a response gets prefetched
+	Threshold uint8 `default:"10" validate:"gt=0,lte=100" yaml:"threshold" json:"threshold" toml:"threshold"`
 }
 
 type TailscaleZoneConfig struct {
@@ -35,6 +282,27 @@ type TailscaleZoneConfig struct {
 	CnameTtl         uint32 `default:"3600" validate:"gt=0" yaml:"cnameTTL" json:"cnameTTL" toml:"cnameTTL"`
 }
 
+type AutoHTTPSConfig struct {
+	Enabled bool     `default:"false" yaml:"enabled" json:"enabled" toml:"enabled"`
+	ALPN    []string `default:"[\"h2\",\"http/1.1\"]" validate:"dive,required,max=255" yaml:"alpn" json:"alpn" toml:"alpn"`
+}
+
+// ServiceConfig is shortcut syntax for a DNS-SD service instance (RFC 6763)
+type ServiceConfig struct {
+	BaseRecord
+	// Instance is the user-facing name of the service, ie "Office Printer"
+	Instance string `validate:"required,max=63" yaml:"instance" json:"instance" toml:"instance"`
+	// Type is the service type, with or without the leading underscore, ie "ipp" or "_home-assistant"
+	Type     string `validate:"required" yaml:"type" json:"type" toml:"type"`
+	Protocol string `default:"tcp" validate:"oneof=tcp udp _tcp _udp" yaml:"protocol" json:"protocol" toml:"protocol"`
+	// Host is the machine providing the service, either relative to the zone or as an FQDN with a trailing dot
+	Host     string            `validate:"required" yaml:"host" json:"host" toml:"host"`
+	Port     uint16            `validate:"required,gt=0" yaml:"port" json:"port" toml:"port"`
+	Priority uint16            `default:"0" validate:"gte=0" yaml:"priority" json:"priority" toml:"priority"`
+	Weight   uint16            `default:"0" validate:"gte=0" yaml:"weight" json:"weight" toml:"weight"`
+	TXT      map[string]string `yaml:"txt" json:"txt" toml:"txt"`
+}
+
 func (cfg *ServerConfigFile) InitializeAndSetDefaults() error {
 	cfg.DefaultForwardConfig = new(ForwardConfig)
 
@@ -45,3 +313,114 @@ func (cfg *ServerConfigFile) InitializeAndSetDefaults() error {
 
 	return nil
 }
+
+// SetRecordDefaults fills in defaults (ie TTLs) for static records, per-zone settings and optional sections. This has to
+// run after the config file is unmarshalled, since those do not exist yet when InitializeAndSetDefaults is called.
+func (cfg *ServerConfigFile) SetRecordDefaults() error {
+	if cfg.DefaultForwardConfig != nil {
+		if err := defaults.Set(cfg.DefaultForwardConfig); err != nil {
+			err = errors.Join(fmt.Errorf("failed to set default forward config defaults"), err)
+			return err
+		}
+	}
+
+	if cfg.TLS != nil {
+		if err := defaults.Set(cfg.TLS); err != nil {
+			err = errors.Join(fmt.Errorf("failed to set tls defaults"), err)
+			return err
+		}
+	}
+	if cfg.DoT != nil {
+		if err := defaults.Set(cfg.DoT); err != nil {
+			err = errors.Join(fmt.Errorf("failed to set dot defaults"), err)
+			return err
+		}
+	}
+	if cfg.DoH != nil {
+		if err := defaults.Set(cfg.DoH); err != nil {
+			err = errors.Join(fmt.Errorf("failed to set doh defaults"), err)
+			return err
+		}
+	}
+	if cfg.DoQ != nil {
+		if err := defaults.Set(cfg.DoQ); err != nil {
+			err = errors.Join(fmt.Errorf("failed to set doq defaults"), err)
+			return err
+		}
+	}
+
+	if cfg.RateLimit != nil {
+		if err := defaults.Set(cfg.RateLimit); err != nil {
+			err = errors.Join(fmt.Errorf("failed to set rate limit defaults"), err)
+			return err
+		}
+	}
+	if cfg.Filter != nil {
+		if err := defaults.Set(cfg.Filter); err != nil {
+			err = errors.Join(fmt.Errorf("failed to set filter defaults"), err)
+			return err
+		}
+	}
+
+	for _, zone := range cfg.AllZones() {
+		if zone.RateLimit != nil {
+			if err := defaults.Set(zone.RateLimit); err != nil {
+				err = errors.Join(fmt.Errorf("failed to set rate limit defaults for zone %s", zone.Name), err)
+				return err
+			}
+		}
+		if zone.ForwardConfig != nil {
+			if err := defaults.Set(zone.ForwardConfig); err != nil {
+				err = errors.Join(fmt.Errorf("failed to set forward config defaults for zone %s", zone.Name), err)
+				return err
+			}
+		}
+		if zone.Records != nil {
+			if err := defaults.Set(zone.Records); err != nil {
+				err = errors.Join(fmt.Errorf("failed to set record defaults for zone %s", zone.Name), err)
+				return err
+			}
+		}
+		for _, svc := range zone.Services {
+			if err := defaults.Set(svc); err != nil {
+				err = errors.Join(fmt.Errorf("failed to set service defaults for zone %s", zone.Name), err)
+				return err
+			}
+		}
+		if zone.AutoHTTPS != nil {
+			if err := defaults.Set(zone.AutoHTTPS); err != nil {
+				err = errors.Join(fmt.Errorf("failed to set autoHttps defaults for zone %s", zone.Name), err)
+				return err
+			}
+		}
+		if zone.Tailscale != nil {
+			if err := defaults.Set(zone.Tailscale); err != nil {
+				err = errors.Join(fmt.Errorf("failed to set tailscale defaults for zone %s", zone.Name), err)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// AllZones returns the zones of every view, including the default one
+func (cfg *ServerConfigFile) AllZones() []*ZoneConfig {
+	var zones []*ZoneConfig
+	for _, zone := range cfg.Zones {
+		if zone != nil {
+			zones = append(zones, zone)
+		}
+	}
+	for _, view := range cfg.Views {
+		if view == nil {
+			continue
+		}
+		for _, zone := range view.Zones {
+			if zone != nil {
+				zones = append(zones, zone)
+			}
+		}
+	}
+	return zones
+}
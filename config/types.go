@@ -0,0 +1,49 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// StringList is a list of strings that may also be written as a single string in the config file, which keeps older
+// configs that only had a single value working
+type StringList []string
+
+func (sl *StringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*sl = StringList{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("expected a string or a list of strings: %w", err)
+	}
+	*sl = list
+	return nil
+}
+
+func (sl *StringList) UnmarshalTOML(value *unstable.Node) error {
+	switch value.Kind {
+	case unstable.String:
+		*sl = StringList{string(value.Data)}
+		return nil
+	case unstable.Array:
+		list := StringList{}
+		it := value.Children()
+		for it.Next() {
+			n := it.Node()
+			if n.Kind != unstable.String {
+				return fmt.Errorf("expected a list of strings, found %s", n.Kind)
+			}
+			list = append(list, string(n.Data))
+		}
+		*sl = list
+		return nil
+	default:
+		return fmt.Errorf("expected a string or a list of strings, found %s", value.Kind)
+	}
+}
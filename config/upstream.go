@@ -0,0 +1,160 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Upstream transports, named after the dns.Client Net values where one exists
+const (
+	UpstreamAuto  = ""
+	UpstreamUDP   = "udp"
+	UpstreamTCP   = "tcp"
+	UpstreamTLS   = "tcp-tls"
+	UpstreamHTTPS = "https"
+)
+
+// Upstream is a parsed ForwardConfig address. Bare IPs are accepted for backwards compatibility and use the same
+// transport the client queried over.
+type Upstream struct {
+	Net string
+	// Addr is the host:port that gets dialed
+	Addr string
+	// ServerName is used for SNI and certificate verification on encrypted transports
+	ServerName string
+	// URL is the DoH endpoint, only set for https upstreams
+	URL string
+}
+
+func (u *Upstream) String() string {
+	switch u.Net {
+	case UpstreamAuto:
+		return u.Addr
+	case UpstreamHTTPS:
+		return u.URL
+	case UpstreamTLS:
+		return "tls://" + u.Addr + "@" + u.ServerName
+	default:
+		return u.Net + "://" + u.Addr
+	}
+}
+
+// ParseUpstream reads an upstream address. Supported forms are:
+//   - a bare IP, optionally with a port (1.1.1.1, 10.0.0.1:5353, [::1]:53)
+//   - udp:// or tcp:// with a host and optional port (udp://10.0.0.1:5353)
+//   - tls:// with a host, optionally pinning the dialed IP in front of the server name (tls://1.1.1.1@cloudflare-dns.com,
+//     tls://[2606:4700::1111]:853@cloudflare-dns.com)
+//   - https:// DoH endpoints, with the same IP pinning (https://dns.quad9.net/dns-query)
+func ParseUpstream(raw string) (*Upstream, error) {
+	if addr, err := netip.ParseAddr(raw); err == nil {
+		return &Upstream{Net: UpstreamAuto, Addr: net.JoinHostPort(addr.String(), "53")}, nil
+	}
+	if addrPort, err := netip.ParseAddrPort(raw); err == nil {
+		return &Upstream{Net: UpstreamAuto, Addr: addrPort.String()}, nil
+	}
+
+	// The pin is split off by hand, since url.Parse does not accept a bracketed IPv6 address as userinfo
+	pin, rest := splitPin(raw)
+	u, err := url.Parse(rest)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("invalid upstream %q", raw), err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("upstream %q has no host", raw)
+	}
+
+	var defaultPort string
+	switch u.Scheme {
+	case "udp", "tcp":
+		if pin != "" {
+			return nil, fmt.Errorf("upstream %q cannot pin an address, since %s does not use a server name", raw, u.Scheme)
+		}
+		return &Upstream{Net: u.Scheme, Addr: hostPort(u.Hostname(), u.Port(), "53")}, nil
+	case "tls":
+		defaultPort = "853"
+	case "https":
+		defaultPort = "443"
+	default:
+		return nil, fmt.Errorf("upstream %q has unsupported scheme %q", raw, u.Scheme)
+	}
+
+	up := &Upstream{ServerName: u.Hostname(), Addr: hostPort(u.Hostname(), u.Port(), defaultPort)}
+	if pin != "" {
+		// The dialed address is given as userinfo, ie tls://1.1.1.1@cloudflare-dns.com or tls://[::1]:8853@example.com
+		pinned, port, err := parsePin(pin)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q pins %q, which is not an IP address", raw, pin)
+		}
+		if port == "" {
+			port = u.Port()
+		}
+		up.Addr = hostPort(pinned.String(), port, defaultPort)
+	}
+	if _, port, _ := net.SplitHostPort(up.Addr); !validPort(port) {
+		return nil, fmt.Errorf("upstream %q has an invalid port", raw)
+	}
+
+	if u.Scheme == "tls" {
+		up.Net = UpstreamTLS
+		return up, nil
+	}
+
+	up.Net = UpstreamHTTPS
+	endpoint := *u
+	if endpoint.Path == "" {
+		endpoint.Path = "/dns-query"
+	}
+	up.URL = endpoint.String()
+	return up, nil
+}
+
+// splitPin removes the userinfo (the pinned address) from an upstream URL
+func splitPin(raw string) (string, string) {
+	scheme, rest, ok := strings.Cut(raw, "://")
+	if !ok {
+		return "", raw
+	}
+	authority, path, hasPath := strings.Cut(rest, "/")
+	pin, host, ok := strings.Cut(authority, "@")
+	if !ok {
+		return "", raw
+	}
+	rest = scheme + "://" + host
+	if hasPath {
+		rest += "/" + path
+	}
+	return pin, rest
+}
+
+// parsePin reads a pinned address with an optional port: 1.1.1.1, 1.1.1.1:853, 2606:4700::1111, [2606:4700::1111] or
+// [2606:4700::1111]:853
+func parsePin(pin string) (netip.Addr, string, error) {
+	if addrPort, err := netip.ParseAddrPort(pin); err == nil {
+		return addrPort.Addr(), strconv.Itoa(int(addrPort.Port())), nil
+	}
+	if bracketed, ok := strings.CutPrefix(pin, "["); ok {
+		pin, ok = strings.CutSuffix(bracketed, "]")
+		if !ok {
+			return netip.Addr{}, "", fmt.Errorf("unterminated IPv6 address %q", bracketed)
+		}
+	}
+	addr, err := netip.ParseAddr(pin)
+	return addr, "", err
+}
+
+func hostPort(host string, port string, defaultPort string) string {
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func validPort(port string) bool {
+	p, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && p > 0
+}
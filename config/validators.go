@@ -1,6 +1,8 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"github.com/go-playground/validator/v10"
 	"strings"
 )
@@ -12,6 +14,105 @@ func RegisterAllValidators(v *validator.Validate) error {
 	if err := v.RegisterValidation("subdomain_part", validatorSubdomainPart); err != nil {
 		return err
 	}
+	if err := v.RegisterValidation("upstream", validatorUpstream); err != nil {
+		return err
+	}
+	if err := v.RegisterValidation("edns_option", validatorEDNSOption); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Validate checks the config against its validation tags, along with the rules that span several fields or zones
+func (cfg *ServerConfigFile) Validate() error {
+	v := validator.New()
+	if err := RegisterAllValidators(v); err != nil {
+		return err
+	}
+
+	if cfg.DefaultForwardConfig != nil && len(cfg.DefaultForwardConfig.Addresses) > 0 {
+		if err := v.Struct(cfg.DefaultForwardConfig); err != nil {
+			return errors.Join(errors.New("invalid default forward config"), err)
+		}
+	}
+
+	if cfg.TLS != nil {
+		if err := v.Struct(cfg.TLS); err != nil {
+			return errors.Join(errors.New("invalid tls config"), err)
+		}
+	}
+	if cfg.DoT != nil {
+		if err := v.Struct(cfg.DoT); err != nil {
+			return errors.Join(errors.New("invalid dot config"), err)
+		}
+	}
+	if cfg.DoH != nil {
+		if err := v.Struct(cfg.DoH); err != nil {
+			return errors.Join(errors.New("invalid doh config"), err)
+		}
+	}
+	if cfg.DoQ != nil {
+		if err := v.Struct(cfg.DoQ); err != nil {
+			return errors.Join(errors.New("invalid doq config"), err)
+		}
+	}
+
+	if cfg.RateLimit != nil {
+		if err := v.Struct(cfg.RateLimit); err != nil {
+			return errors.Join(errors.New("invalid rate limit config"), err)
+		}
+	}
+
+	if cfg.Filter != nil {
+		if err := v.Struct(cfg.Filter); err != nil {
+			return errors.Join(errors.New("invalid filter config"), err)
+		}
+		if cfg.Filter.Response == FilterSinkhole && cfg.Filter.SinkholeIPv4 == "" && cfg.Filter.SinkholeIPv6 == "" {
+			return errors.New("filter response is sinkhole but no sinkhole addresses are set")
+		}
+	}
+
+	viewNames := make(map[string]struct{})
+	for _, view := range cfg.Views {
+		if view == nil {
+			continue
+		}
+		if err := v.Struct(view); err != nil {
+			return errors.Join(errors.New("invalid view"), err)
+		}
+		if _, ok := viewNames[view.Name]; ok {
+			return fmt.Errorf("view %s is defined more than once", view.Name)
+		}
+		viewNames[view.Name] = struct{}{}
+		if len(view.Clients) == 0 && len(view.Listeners) == 0 {
+			return fmt.Errorf("view %s must match on clients and/or listeners", view.Name)
+		}
+		for _, zone := range view.Zones {
+			if zone != nil && len(zone.Bind) > 0 {
+				return fmt.Errorf("zone %s in view %s cannot set bind, use the view's listeners instead", zone.Name, view.Name)
+			}
+		}
+	}
+
+	for _, zone := range cfg.AllZones() {
+		// This covers the zone's forward config, records, services and other settings as well
+		if err := v.Struct(zone); err != nil {
+			return errors.Join(fmt.Errorf("invalid zone %s", zone.Name), err)
+		}
+		if zone.Records == nil {
+			continue
+		}
+		for rrType, recMap := range map[string]map[string][]SVCBRecord{"SVCB": zone.Records.SVCB, "HTTPS": zone.Records.HTTPS} {
+			for name, recs := range recMap {
+				for _, rec := range recs {
+					if rec.Priority == 0 && rec.HasParams() {
+						return fmt.Errorf("%s record %s in zone %s is in alias mode (priority 0) and cannot have parameters", rrType, name, zone.Name)
+					}
+				}
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -46,3 +147,25 @@ func validatorSubdomainPart(fl validator.FieldLevel) bool {
 		return strings.HasPrefix(sp, ".") && strings.HasSuffix(sp, ".")
 	}
 }
+
+func validatorUpstream(fl validator.FieldLevel) bool {
+	up, ok := fl.Field().Interface().(string)
+
+	if !ok {
+		return false
+	}
+
+	_, err := ParseUpstream(up)
+	return err == nil
+}
+
+func validatorEDNSOption(fl validator.FieldLevel) bool {
+	opt, ok := fl.Field().Interface().(string)
+
+	if !ok {
+		return false
+	}
+
+	_, err := ParseEDNSOption(opt)
+	return err == nil
+}
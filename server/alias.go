@@ -0,0 +1,128 @@
+package server
+
+import (
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxAliasChainLength caps how many ALIAS targets are resolved through one another for a single query
+const maxAliasChainLength = 8
+
+// aliasChain holds the (lowercase) ALIAS targets being resolved for a query, so that ALIAS records which lead back to
+// themselves fail instead of recursing forever
+type aliasChain map[string]struct{}
+
+// with returns a copy of the chain with a target added
+func (ac aliasChain) with(target string) aliasChain {
+	chain := make(aliasChain, len(ac)+1)
+	for name := range ac {
+		chain[name] = struct{}{}
+	}
+	chain[target] = struct{}{}
+	return chain
+}
+
+type aliasCacheKey struct {
+	target string
+	qtype  uint16
+}
+
+type aliasCacheEntry struct {
+	answers []dns.RR
+	expires time.Time
+}
+
+// HandleAlias resolves an ALIAS target at query time and synthesizes A/AAAA records for the owner name. Local zones are
+// checked first, then the zone's forwarder or recursor. Results are cached for the lowest TTL seen. aliases holds the
+// targets already being resolved for the query, and the lookup fails if target is one of them.
+func (zi *ZoneInstance) HandleAlias(q dns.Question, target string, ttl uint32, aliases aliasChain) ([]dns.RR, bool) {
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return nil, false
+	}
+
+	target = dns.Fqdn(target)
+	key := aliasCacheKey{target: strings.ToLower(target), qtype: q.Qtype}
+
+	if _, ok := aliases[key.target]; ok {
+		zi.qLog.Warn().Msgf("ALIAS loop detected at %s (%s)", target, q.Name)
+		return nil, false
+	}
+	if len(aliases) >= maxAliasChainLength {
+		zi.qLog.Warn().Msgf("ALIAS chain exceeded %d steps, not following further (%s)", maxAliasChainLength, q.Name)
+		return nil, false
+	}
+
+	zi.aliasMu.Lock()
+	entry, ok := zi.aliasCache[key]
+	zi.aliasMu.Unlock()
+
+	if !ok || time.Now().After(entry.expires) {
+		answers, found := zi.resolveAliasTarget(dns.Question{Name: target, Qtype: q.Qtype, Qclass: dns.ClassINET}, aliases.with(key.target))
+		if !found {
+			zi.qLog.Warn().Msgf("Could not resolve ALIAS target %s (%s)", target, q.Name)
+			return nil, false
+		}
+
+		minTtl := ttl
+		for _, rr := range answers {
+			minTtl = min(minTtl, rr.Header().Ttl)
+		}
+		entry = aliasCacheEntry{answers: answers, expires: time.Now().Add(time.Duration(minTtl) * time.Second)}
+
+		zi.aliasMu.Lock()
+		zi.aliasCache[key] = entry
+		zi.aliasMu.Unlock()
+	} else {
+		zi.qLog.Debug().Msgf("Using cached ALIAS answer for %s (%s)", target, q.Name)
+	}
+
+	remaining := uint32(time.Until(entry.expires).Round(time.Second).Seconds())
+	var synthesized []dns.RR
+	for _, rr := range entry.answers {
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		rr.Header().Ttl = remaining
+		synthesized = append(synthesized, rr)
+	}
+	return synthesized, len(synthesized) > 0
+}
+
+// resolveAliasTarget looks up the records of the requested type for an ALIAS target, dropping any CNAMEs along the way.
+// aliases includes the target itself.
+func (zi *ZoneInstance) resolveAliasTarget(q dns.Question, aliases aliasChain) ([]dns.RR, bool) {
+	var (
+		msg   *dns.Msg
+		found = false
+	)
+
+	if zi.zoneLookup != nil {
+		if zone, ok := zi.zoneLookup(q.Name); ok {
+			// ALIAS answers are shared by all clients, so only unscoped records are used
+			if msg, found = zone.HandleLocal(q, netip.Addr{}, aliases); found {
+				zone.ChaseCname(q, msg, netip.Addr{}, aliases)
+			}
+		}
+	}
+	if !found && zi.Forward && zi.ForwardConfig != nil {
+		req := new(dns.Msg)
+		req.SetQuestion(q.Name, q.Qtype)
+		msg, found = zi.HandleForward(req, "udp")
+	}
+	if !found && zi.RecursionEnabled {
+		msg, found = zi.HandleRecursiveResolve(q, "udp")
+	}
+	if !found || msg == nil {
+		return nil, false
+	}
+
+	var answers []dns.RR
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype == q.Qtype {
+			answers = append(answers, rr)
+		}
+	}
+	return answers, len(answers) > 0
+}
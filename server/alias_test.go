@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestHandleAlias(t *testing.T) {
+	srv := loadTestServer(t, `
+zones:
+  - name: example.com.
+    forwardEnabled: false
+    records:
+      A:
+        lb: [{address: 192.0.2.1}]
+      CNAME:
+        www: [{target: lb.example.com.}]
+        back: [{target: example.com.}]
+        loopback: [{target: cnameloop.example.com.}]
+      ALIAS:
+        "@": [{target: www.example.com.}]
+        self: [{target: self.example.com.}]
+        ping: [{target: pong.example.com.}]
+        pong: [{target: ping.example.com.}]
+        viacname: [{target: back.example.com.}]
+        cnameloop: [{target: loopback.example.com.}]
+        chain: [{target: chain2.example.com.}]
+        chain2: [{target: example.com.}]
+`)
+	zone := srv.zones["example.com."]
+
+	tests := []struct {
+		name  string
+		owner string
+		found bool
+	}{
+		{name: "through cname", owner: "example.com.", found: true},
+		{name: "through another alias", owner: "chain.example.com.", found: true},
+		{name: "self loop", owner: "self.example.com.", found: false},
+		{name: "mutual loop", owner: "ping.example.com.", found: false},
+		{name: "through cname to another alias", owner: "viacname.example.com.", found: true},
+		{name: "loop through cname", owner: "cnameloop.example.com.", found: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, found := zone.HandleRecords(dns.Question{Name: tt.owner, Qtype: dns.TypeA, Qclass: dns.ClassINET}, netip.Addr{}, nil)
+			if found != tt.found {
+				t.Fatalf("found = %v, want %v", found, tt.found)
+			}
+			if !found {
+				return
+			}
+			if len(msg.Answer) != 1 {
+				t.Fatalf("got %d answers, want 1: %v", len(msg.Answer), msg.Answer)
+			}
+			a, ok := msg.Answer[0].(*dns.A)
+			if !ok || a.Hdr.Name != tt.owner || a.A.String() != "192.0.2.1" {
+				t.Errorf("unexpected answer %v", msg.Answer[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/creasty/defaults"
+	"github.com/henrikvtcodes/tungsten/config"
+	"github.com/henrikvtcodes/tungsten/util"
+	"github.com/miekg/dns"
+	"tailscale.com/util/slicesx"
+)
+
+// buildNameIndex records every owner name that exists in the static records (including empty non-terminals), so that
+// negative answers can tell NXDOMAIN apart from NODATA
+func (zi *ZoneInstance) buildNameIndex() {
+	index := map[string]struct{}{strings.ToLower(zi.Name): {}}
+
+	if rc := zi.StaticRecords; rc != nil {
+		keySets := [][]string{
+			slicesx.MapKeys(rc.A),
+			slicesx.MapKeys(rc.AAAA),
+			slicesx.MapKeys(rc.CNAME),
+			slicesx.MapKeys(rc.MX),
+			slicesx.MapKeys(rc.TXT),
+			slicesx.MapKeys(rc.SRV),
+			slicesx.MapKeys(rc.CAA),
+			slicesx.MapKeys(rc.PTR),
+			slicesx.MapKeys(rc.NS),
+			slicesx.MapKeys(rc.SVCB),
+			slicesx.MapKeys(rc.HTTPS),
+			slicesx.MapKeys(rc.ALIAS),
+		}
+		for _, keys := range keySets {
+			for _, key := range keys {
+				zi.indexName(index, strings.ToLower(zi.ownerName(key)))
+			}
+		}
+	}
+
+	zi.names = index
+}
+
+// indexName adds a name and all of its parents up to the zone apex to the index
+func (zi *ZoneInstance) indexName(index map[string]struct{}, name string) {
+	apex := strings.ToLower(zi.Name)
+	for dns.IsSubDomain(apex, name) && name != apex {
+		index[name] = struct{}{}
+		parent, ok := parentName(name)
+		if !ok {
+			return
+		}
+		name = parent
+	}
+}
+
+// parentName strips the first label off a name, taking escaped dots within labels into account
+func parentName(name string) (string, bool) {
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return "", false
+	}
+	return name[off:], true
+}
+
+// nameExists checks whether a name exists in this zone, either as a static record owner, a Tailscale entry, or through
+// wildcard synthesis
+func (zi *ZoneInstance) nameExists(name string) bool {
+	if zi.nameIndexed(name) || zi.tailscaleNameExists(name) || zi.autoPTRNameExists(name) {
+		return true
+	}
+	_, ok := zi.wildcardKey(name)
+	return ok
+}
+
+// nameIndexed checks whether a name (or one of its descendants) is an owner in the static records
+func (zi *ZoneInstance) nameIndexed(name string) bool {
+	_, ok := zi.names[strings.ToLower(name)]
+	return ok
+}
+
+// tailscaleNameExists checks whether a name matches a Tailscale machine or CNAME entry
+func (zi *ZoneInstance) tailscaleNameExists(name string) bool {
+	if zi.Tailscale != nil && zi.TSClient != nil {
+		sub, _ := strings.CutSuffix(strings.ToLower(name), strings.ToLower(zi.Name))
+		if m, ok := strings.CutSuffix(sub, zi.Tailscale.MachineSubdomain); ok {
+			if _, ok := zi.TSClient.FindMachine(m); ok {
+				return true
+			}
+		} else if c, ok := strings.CutSuffix(sub, zi.Tailscale.CnameSubdomain); ok {
+			if _, ok := zi.TSClient.FindCNameEntry(c); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// wildcardKey finds the records key of the wildcard that synthesizes answers for a name, following RFC 4592: the
+// wildcard must be a child of the closest encloser, and it never applies to a name that exists in its own right
+func (zi *ZoneInstance) wildcardKey(name string) (string, bool) {
+	if zi.nameIndexed(name) || zi.tailscaleNameExists(name) {
+		return "", false
+	}
+
+	apex := strings.ToLower(zi.Name)
+	encloser := strings.ToLower(name)
+	for encloser != apex {
+		parent, ok := parentName(encloser)
+		if !ok || !dns.IsSubDomain(apex, parent) {
+			return "", false
+		}
+		encloser = parent
+		if zi.nameIndexed(encloser) {
+			break
+		}
+	}
+
+	source := "*." + encloser
+	if !zi.nameIndexed(source) {
+		return "", false
+	}
+	return zi.recordKey(source), true
+}
+
+// recordKey converts a name into the key used by the static records maps. Matching is case-insensitive, and the apex
+// maps to config.ApexKey
+func (zi *ZoneInstance) recordKey(name string) string {
+	name = strings.ToLower(name)
+	apex := strings.ToLower(zi.Name)
+	if name == apex {
+		return config.ApexKey
+	}
+	if apex == "." {
+		return strings.TrimSuffix(name, ".")
+	}
+	key, _ := strings.CutSuffix(name, "."+apex)
+	return key
+}
+
+// ownerName converts a static records key back into a fully qualified name in this zone
+func (zi *ZoneInstance) ownerName(key string) string {
+	if key == config.ApexKey {
+		return zi.Name
+	}
+	return dns.Fqdn(key + "." + strings.TrimSuffix(zi.Name, "."))
+}
+
+// IsAuthoritative reports whether this zone is the final authority for its names, ie it has local data and will never
+// hand a query off to a forwarder or recursor
+func (zi *ZoneInstance) IsAuthoritative() bool {
+	if zi.Forward && zi.ForwardConfig != nil {
+		return false
+	}
+	if zi.RecursionEnabled {
+		return false
+	}
+	return zi.StaticRecords != nil || zi.Tailscale != nil || zi.AutoPTR
+}
+
+// populateSOA determines the SOA for the zone, falling back to a generated one if none is configured. The generated
+// one is only used for the zone's own negative answers, and answered directly only if the zone is authoritative.
+func (zi *ZoneInstance) populateSOA() error {
+	if zi.StaticRecords != nil && zi.StaticRecords.SOA != nil {
+		zi.soa = zi.StaticRecords.SOA
+		return nil
+	}
+
+	soa := new(config.SOARecord)
+	if err := defaults.Set(soa); err != nil {
+		return err
+	}
+	soa.Ns = zi.Name
+	soa.Mbox = "hostmaster." + zi.Name
+	zi.soa = soa
+	return nil
+}
+
+// soaRecord returns the zone's SOA as an RR with the given owner name and TTL
+func (zi *ZoneInstance) soaRecord(owner string, ttl uint32) dns.RR {
+	return util.SOARecord(owner, zi.soa.Ns, zi.soa.Mbox, zi.soa.Serial, zi.soa.Refresh, zi.soa.Retry, zi.soa.Expire, zi.soa.MinTTL, ttl)
+}
+
+// NegativeResponse builds an authoritative NXDOMAIN or NODATA answer with the zone's SOA in the authority section
+func (zi *ZoneInstance) NegativeResponse(q dns.Question) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.Authoritative = true
+
+	if zi.nameExists(q.Name) {
+		zi.qLog.Info().Msgf("Name exists but has no records of the requested type (%s)", q.Name)
+	} else {
+		zi.qLog.Info().Msgf("Name does not exist (%s)", q.Name)
+		msg.Rcode = dns.RcodeNameError
+	}
+
+	// RFC 2308 §5: the negative caching TTL is the lesser of the SOA TTL and its MINIMUM field
+	msg.Ns = []dns.RR{zi.soaRecord(zi.Name, min(zi.soa.TTL, zi.soa.MinTTL))}
+	return msg
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAuthoritativeAnswers(t *testing.T) {
+	srv := loadTestServer(t, `
+zones:
+  - name: example.com.
+    forwardEnabled: false
+    records:
+      SOA: {ns: ns1.example.com., mbox: hostmaster.example.com., ttl: 600, minTTL: 300}
+      A:
+        www: [{address: 192.0.2.1}]
+        a.b: [{address: 192.0.2.2}]
+      TXT:
+        "@": [{content: hello}]
+  - name: generated.test.
+    forwardEnabled: false
+    records:
+      A:
+        www: [{address: 192.0.2.3}]
+`)
+	soa := []string{"example.com. SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"}
+	generated := []string{"generated.test. SOA generated.test. hostmaster.generated.test. 1 7200 3600 1209600 3600"}
+
+	tests := []struct {
+		name   string
+		zone   string
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer []string
+		ns     []string
+		ttl    uint32
+	}{
+		{name: "answer", zone: "example.com.", qname: "www.example.com.", qtype: dns.TypeA, answer: []string{"www.example.com. A 192.0.2.1"}},
+		{name: "case insensitive", zone: "example.com.", qname: "WWW.Example.COM.", qtype: dns.TypeA, answer: []string{"WWW.Example.COM. A 192.0.2.1"}},
+		{name: "nodata", zone: "example.com.", qname: "www.example.com.", qtype: dns.TypeAAAA, ns: soa, ttl: 300},
+		{name: "nxdomain", zone: "example.com.", qname: "nope.example.com.", qtype: dns.TypeA, rcode: dns.RcodeNameError, ns: soa, ttl: 300},
+		{name: "empty non-terminal", zone: "example.com.", qname: "b.example.com.", qtype: dns.TypeA, ns: soa, ttl: 300},
+		{name: "below existing name", zone: "example.com.", qname: "x.www.example.com.", qtype: dns.TypeA, rcode: dns.RcodeNameError, ns: soa, ttl: 300},
+		{name: "apex soa", zone: "example.com.", qname: "example.com.", qtype: dns.TypeSOA, answer: []string{"example.com. SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"}},
+		{name: "soa below apex", zone: "example.com.", qname: "www.example.com.", qtype: dns.TypeSOA, ns: soa, ttl: 300},
+		{name: "generated soa", zone: "generated.test.", qname: "generated.test.", qtype: dns.TypeSOA, answer: generated},
+		{name: "generated soa in nxdomain", zone: "generated.test.", qname: "nope.generated.test.", qtype: dns.TypeA, rcode: dns.RcodeNameError, ns: generated, ttl: 3600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := exchange(t, srv.zones[tt.zone], new(dns.Msg).SetQuestion(tt.qname, tt.qtype), "192.0.2.10")
+			if res.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[res.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if !res.Authoritative {
+				t.Error("AA is not set")
+			}
+			if got := rrStrings(res.Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+			if got := rrStrings(res.Ns); !slices.Equal(got, tt.ns) {
+				t.Errorf("authority = %q, want %q", got, tt.ns)
+			}
+			// RFC 2308: the SOA in a negative answer has the lesser of its TTL and MINIMUM
+			if len(res.Ns) > 0 && res.Ns[0].Header().Ttl != tt.ttl {
+				t.Errorf("authority TTL = %d, want %d", res.Ns[0].Header().Ttl, tt.ttl)
+			}
+		})
+	}
+}
+
+func TestGeneratedSOANotAnsweredWhenForwarding(t *testing.T) {
+	srv := loadTestServer(t, `
+zones:
+  - name: corp.example.
+    forwardEnabled: true
+    forwardConfig:
+      addresses: ["127.0.0.1:1"]
+    records:
+      A:
+        www: [{address: 192.0.2.1}]
+  - name: configured.example.
+    forwardEnabled: true
+    forwardConfig:
+      addresses: ["127.0.0.1:1"]
+    records:
+      SOA: {ns: ns1.configured.example., mbox: hostmaster.configured.example.}
+`)
+	tests := []struct {
+		zone  string
+		found bool
+	}{
+		{zone: "corp.example.", found: false},
+		{zone: "configured.example.", found: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.zone, func(t *testing.T) {
+			zone := srv.zones[tt.zone]
+			if zone.IsAuthoritative() {
+				t.Fatal("forwarding zone is authoritative")
+			}
+			_, found := zone.HandleRecords(dns.Question{Name: tt.zone, Qtype: dns.TypeSOA, Qclass: dns.ClassINET}, netip.Addr{}, nil)
+			if found != tt.found {
+				t.Errorf("found = %v, want %v", found, tt.found)
+			}
+		})
+	}
+}
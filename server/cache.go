@@ -0,0 +1,279 @@
+package server
+
+import (
+	"container/list"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henrikvtcodes/tungsten/config"
+	"github.com/miekg/dns"
+)
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+	// ecs is the client subnet sent upstream, since the answer may be tailored to it
+	ecs string
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+	// staleUntil is when the entry is dropped for good, which is later than expires if serve-stale is enabled
+	staleUntil time.Time
+
+	ttl         uint32
+	hits        uint32
+	prefetching bool
+}
+
+// ResponseCache is a size-bounded LRU cache of upstream responses, shared by every zone that forwards or recurses
+type ResponseCache struct {
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+
+	size      int
+	maxTtl    uint32
+	maxNegTtl uint32
+}
+
+// NewResponseCache creates a cache from the config, or returns nil if caching is disabled
+func NewResponseCache(conf *config.CacheConfig) *ResponseCache {
+	if conf == nil || !conf.Enabled || conf.Size <= 0 {
+		return nil
+	}
+	return &ResponseCache{
+		entries:   make(map[cacheKey]*list.Element),
+		lru:       list.New(),
+		size:      conf.Size,
+		maxTtl:    conf.MaxTTL,
+		maxNegTtl: conf.MaxNegativeTTL,
+	}
+}
+
+// zoneCache returns the response cache a zone should use, which is nil if the zone has opted out
+func zoneCache(cache *ResponseCache, conf *config.ZoneConfig) *ResponseCache {
+	if cache == nil || conf.NoCache {
+		return nil
+	}
+	return cache
+}
+
+func newCacheKey(req *dns.Msg) cacheKey {
+	q := req.Question[0]
+	opt := req.IsEdns0()
+	return cacheKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+		do:     opt != nil && opt.Do(),
+		ecs:    subnetKey(req),
+	}
+}
+
+// subnetKey identifies the EDNS Client Subnet of a query, if it has one
+func subnetKey(req *dns.Msg) string {
+	subnet := requestSubnet(req)
+	if subnet == nil {
+		return ""
+	}
+	addr, _ := netip.AddrFromSlice(subnet.Address)
+	prefix, _ := addr.Unmap().Prefix(int(subnet.SourceNetmask))
+	return prefix.String()
+}
+
+// Get returns a copy of the cached response to a query, with TTLs reduced by the time it has spent in the cache
+func (rc *ResponseCache) Get(req *dns.Msg) (*dns.Msg, bool) {
+	entry, ok := rc.lookup(req)
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+
+	rc.mu.Lock()
+	entry.hits++
+	rc.mu.Unlock()
+
+	elapsed := uint32(time.Since(entry.stored).Seconds())
+	return copyWithTtl(entry.msg, func(ttl uint32) uint32 { return ttl - min(elapsed, ttl) }), true
+}
+
+// GetStale returns an expired response that is still within its serve-stale window, with every TTL set to ttl
+func (rc *ResponseCache) GetStale(req *dns.Msg, ttl uint32) (*dns.Msg, bool) {
+	entry, ok := rc.lookup(req)
+	if !ok {
+		return nil, false
+	}
+	return copyWithTtl(entry.msg, func(uint32) uint32 { return ttl }), true
+}
+
+// ShouldPrefetch reports whether a cached response has been popular enough and is close enough to expiring that it
+// should be refreshed now. It only returns true once per entry, so the caller is expected to refresh it.
+func (rc *ResponseCache) ShouldPrefetch(req *dns.Msg, minHits uint32, threshold uint8) bool {
+	entry, ok := rc.lookup(req)
+	if !ok {
+		return false
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	remaining := time.Until(entry.expires)
+	window := time.Duration(entry.ttl) * time.Second * time.Duration(threshold) / 100
+	if entry.prefetching || entry.hits < minHits || remaining <= 0 || remaining > window {
+		return false
+	}
+	entry.prefetching = true
+	return true
+}
+
+// Set stores a response if it can be cached, for as long as its TTLs allow plus the serve-stale window
+func (rc *ResponseCache) Set(req *dns.Msg, res *dns.Msg, stale time.Duration) {
+	ttl, ok := rc.cacheTtl(res)
+	if !ok {
+		return
+	}
+
+	msg := res.Copy()
+	// Downstream caches keep a negative answer for as long as its SOA TTL, which must not outlast our own entry
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa.Hdr.Ttl = min(soa.Hdr.Ttl, ttl)
+		}
+	}
+
+	key := newCacheKey(req)
+	now := time.Now()
+	expires := now.Add(time.Duration(ttl) * time.Second)
+	entry := &cacheEntry{key: key, msg: msg, stored: now, expires: expires, staleUntil: expires.Add(stale), ttl: ttl}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if elem, ok := rc.entries[key]; ok {
+		// Keep counting hits across refreshes, so popular entries keep getting prefetched
+		entry.hits = elem.Value.(*cacheEntry).hits
+		elem.Value = entry
+		rc.lru.MoveToFront(elem)
+		return
+	}
+	rc.entries[key] = rc.lru.PushFront(entry)
+	for rc.lru.Len() > rc.size {
+		oldest := rc.lru.Back()
+		rc.lru.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// lookup finds the entry for a query, dropping it if even its serve-stale window has passed
+func (rc *ResponseCache) lookup(req *dns.Msg) (*cacheEntry, bool) {
+	key := newCacheKey(req)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	elem, ok := rc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.staleUntil) {
+		rc.lru.Remove(elem)
+		delete(rc.entries, key)
+		return nil, false
+	}
+	rc.lru.MoveToFront(elem)
+	return entry, true
+}
+
+// copyWithTtl copies a cached response, rewriting the TTL of every record except OPT
+func copyWithTtl(msg *dns.Msg, ttl func(uint32) uint32) *dns.Msg {
+	msg = msg.Copy()
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rr.Header().Ttl = ttl(rr.Header().Ttl)
+		}
+	}
+	return msg
+}
+
+// cacheTtl works out how long a response may be cached for. Positive answers use their lowest TTL, while NXDOMAIN and
+// NODATA answers use the SOA in the authority section as described in RFC 2308 section 5. Responses without a SOA,
+// errors and truncated responses are not cached.
+func (rc *ResponseCache) cacheTtl(res *dns.Msg) (uint32, bool) {
+	if res == nil || res.Truncated {
+		return 0, false
+	}
+
+	negative := res.Rcode == dns.RcodeNameError || (res.Rcode == dns.RcodeSuccess && len(res.Answer) == 0)
+	if !negative && res.Rcode != dns.RcodeSuccess {
+		return 0, false
+	}
+
+	if negative {
+		for _, rr := range res.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := min(soa.Hdr.Ttl, soa.Minttl, rc.maxNegTtl)
+				return ttl, ttl > 0
+			}
+		}
+		return 0, false
+	}
+
+	ttl := rc.maxTtl
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+	}
+	return ttl, ttl > 0
+}
+
+// staleWindow is how long forwarded responses are kept in the cache past their expiry
+func (zi *ZoneInstance) staleWindow() time.Duration {
+	if zi.ForwardConfig == nil || zi.ForwardConfig.ServeStale == nil || !zi.ForwardConfig.ServeStale.Enabled {
+		return 0
+	}
+	return time.Duration(zi.ForwardConfig.ServeStale.MaxAge) * time.Second
+}
+
+// serveStale answers with an expired response from the cache after every upstream has failed (RFC 8767)
+func (zi *ZoneInstance) serveStale(req *dns.Msg) (*dns.Msg, bool) {
+	if zi.cache == nil || zi.staleWindow() == 0 {
+		return nil, false
+	}
+	msg, ok := zi.cache.GetStale(req, zi.ForwardConfig.ServeStale.TTL)
+	if ok {
+		zi.qLog.Warn().Msgf("All upstreams failed, serving stale response (%s)", req.Question[0].Name)
+	}
+	return msg, ok
+}
+
+// prefetch refreshes a popular cached response in the background before it expires, so clients keep getting cache hits
+func (zi *ZoneInstance) prefetch(req *dns.Msg, netType string) {
+	if !zi.Forward || zi.ForwardConfig == nil || zi.ForwardConfig.Prefetch == nil || !zi.ForwardConfig.Prefetch.Enabled {
+		return
+	}
+	conf := zi.ForwardConfig.Prefetch
+	if !zi.cache.ShouldPrefetch(req, conf.MinHits, conf.Threshold) {
+		return
+	}
+
+	req = req.Copy()
+	go func() {
+		zi.qLog.Debug().Msgf("Prefetching cached response (%s)", req.Question[0].Name)
+		zi.HandleForward(req, netType)
+	}()
+}
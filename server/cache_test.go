@@ -0,0 +1,162 @@
+package server
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/henrikvtcodes/tungsten/config"
+	"github.com/henrikvtcodes/tungsten/util"
+	"github.com/miekg/dns"
+)
+
+// testResponse builds an upstream response to a query with the given sections
+func testResponse(req *dns.Msg, rcode int, answer []dns.RR, ns []dns.RR) *dns.Msg {
+	res := new(dns.Msg)
+	res.SetRcode(req, rcode)
+	res.Answer = answer
+	res.Ns = ns
+	return res
+}
+
+// age makes a cached response look like it was stored some time ago
+func age(rc *ResponseCache, req *dns.Msg, by time.Duration) {
+	entry, ok := rc.lookup(req)
+	if !ok {
+		return
+	}
+	entry.stored = entry.stored.Add(-by)
+	entry.expires = entry.expires.Add(-by)
+	entry.staleUntil = entry.staleUntil.Add(-by)
+}
+
+func TestResponseCacheTtl(t *testing.T) {
+	rc := NewResponseCache(&config.CacheConfig{Enabled: true, Size: 10, MaxTTL: 3600, MaxNegativeTTL: 900})
+	req := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+	a := func(ttl uint32) dns.RR { return util.ARecord("www.example.com.", net.ParseIP("192.0.2.1"), ttl) }
+	soa := func(ttl uint32, minTtl uint32) dns.RR {
+		return util.SOARecord("example.com.", "ns.example.com.", "hostmaster.example.com.", 1, 7200, 3600, 1209600, minTtl, ttl)
+	}
+	truncated := testResponse(req, dns.RcodeSuccess, []dns.RR{a(300)}, nil)
+	truncated.Truncated = true
+
+	tests := []struct {
+		name string
+		res  *dns.Msg
+		ttl  uint32
+		ok   bool
+	}{
+		{name: "lowest ttl", res: testResponse(req, dns.RcodeSuccess, []dns.RR{a(300), a(60)}, nil), ttl: 60, ok: true},
+		{name: "capped at max ttl", res: testResponse(req, dns.RcodeSuccess, []dns.RR{a(86400)}, nil), ttl: 3600, ok: true},
+		{name: "zero ttl", res: testResponse(req, dns.RcodeSuccess, []dns.RR{a(0)}, nil), ok: false},
+		{name: "nxdomain uses soa minimum", res: testResponse(req, dns.RcodeNameError, nil, []dns.RR{soa(3600, 300)}), ttl: 300, ok: true},
+		{name: "nodata uses soa ttl", res: testResponse(req, dns.RcodeSuccess, nil, []dns.RR{soa(120, 300)}), ttl: 120, ok: true},
+		{name: "negative capped at max negative ttl", res: testResponse(req, dns.RcodeNameError, nil, []dns.RR{soa(7200, 7200)}), ttl: 900, ok: true},
+		{name: "negative without soa", res: testResponse(req, dns.RcodeNameError, nil, nil), ok: false},
+		{name: "servfail", res: testResponse(req, dns.RcodeServerFailure, nil, nil), ok: false},
+		{name: "truncated", res: truncated, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, ok := rc.cacheTtl(tt.res)
+			if ok != tt.ok || ttl != tt.ttl {
+				t.Errorf("cacheTtl = %d, %v, want %d, %v", ttl, ok, tt.ttl, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCachedAnswers(t *testing.T) {
+	srv := loadTestServer(t, `
+cache:
+  maxNegativeTtl: 900
+zones:
+  - name: .
+    forwardEnabled: true
+    forwardConfig:
+      addresses: ["127.0.0.1:1"]
+`)
+	zone := srv.zones["."]
+	soa := util.SOARecord("example.com.", "ns.example.com.", "hostmaster.example.com.", 1, 7200, 3600, 1209600, 300, 3600)
+
+	tests := []struct {
+		name   string
+		qname  string
+		rcode  int
+		answer []dns.RR
+		ns     []dns.RR
+		age    time.Duration
+		want   []uint32
+	}{
+		{
+			name:   "positive",
+			qname:  "www.example.com.",
+			answer: []dns.RR{util.ARecord("www.example.com.", net.ParseIP("192.0.2.1"), 300)},
+			age:    10 * time.Second,
+			want:   []uint32{290},
+		},
+		{
+			name:  "nxdomain",
+			qname: "nope.example.com.",
+			rcode: dns.RcodeNameError,
+			ns:    []dns.RR{soa},
+			age:   10 * time.Second,
+			// The SOA TTL is capped at its MINIMUM field, which the entry is cached for
+			want: []uint32{290},
+		},
+		{
+			name:  "nodata",
+			qname: "example.com.",
+			ns:    []dns.RR{soa},
+			age:   time.Minute,
+			want:  []uint32{240},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg).SetQuestion(tt.qname, dns.TypeA)
+			srv.cache.Set(req, testResponse(req, tt.rcode, tt.answer, tt.ns), 0)
+			age(srv.cache, req, tt.age)
+
+			res := exchange(t, zone, req, "192.0.2.10")
+			if res.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[res.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if res.Authoritative {
+				t.Error("AA is set on a cached answer")
+			}
+			var ttls []uint32
+			for _, rr := range append(res.Answer, res.Ns...) {
+				ttls = append(ttls, rr.Header().Ttl)
+			}
+			if !slices.Equal(ttls, tt.want) {
+				t.Errorf("TTLs = %v, want %v", ttls, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseCacheExpiry(t *testing.T) {
+	rc := NewResponseCache(&config.CacheConfig{Enabled: true, Size: 10, MaxTTL: 3600, MaxNegativeTTL: 900})
+	req := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+	res := testResponse(req, dns.RcodeSuccess, []dns.RR{util.ARecord("www.example.com.", net.ParseIP("192.0.2.1"), 60)}, nil)
+
+	rc.Set(req, res, time.Minute)
+	age(rc, req, 90*time.Second)
+	if _, ok := rc.Get(req); ok {
+		t.Error("expired response was returned")
+	}
+	stale, ok := rc.GetStale(req, 30)
+	if !ok {
+		t.Fatal("stale response was not returned")
+	}
+	if ttl := stale.Answer[0].Header().Ttl; ttl != 30 {
+		t.Errorf("stale TTL = %d, want 30", ttl)
+	}
+
+	age(rc, req, time.Minute)
+	if _, ok := rc.GetStale(req, 30); ok {
+		t.Error("response was returned after its stale window")
+	}
+}
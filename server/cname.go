@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxCnameChainLength caps how many CNAME targets are followed for a single query
+const maxCnameChainLength = 8
+
+// ZoneLookup finds the local zone responsible for a name, the same way dns.ServeMux picks a handler
+type ZoneLookup func(name string) (*ZoneInstance, bool)
+
+// HandleLocal answers a question using only the data this zone holds itself (static records, automatic PTRs and
+// Tailscale), never reaching out to a forwarder or recursor. aliases holds the ALIAS targets already being resolved for
+// the query, if any.
+func (zi *ZoneInstance) HandleLocal(q dns.Question, client netip.Addr, aliases aliasChain) (*dns.Msg, bool) {
+	if msg, ok := zi.HandleRecords(q, client, aliases); ok {
+		return msg, true
+	}
+	if zi.AutoPTR {
+		if msg, ok := zi.HandleAutoPTR(q); ok {
+			return msg, true
+		}
+	}
+	if zi.Tailscale != nil && zi.TSClient != nil {
+		if msg, ok := zi.HandleTailscale(q); ok {
+			return msg, true
+		}
+	}
+	return nil, false
+}
+
+// ChaseCname follows CNAME chains at the end of an answer through the zones that Tungsten serves, appending the
+// records found along the way. Targets outside of the local zones are left for the client to resolve.
+func (zi *ZoneInstance) ChaseCname(q dns.Question, msg *dns.Msg, client netip.Addr, aliases aliasChain) {
+	if q.Qtype == dns.TypeCNAME || q.Qtype == dns.TypeANY || zi.zoneLookup == nil {
+		return
+	}
+
+	seen := map[string]struct{}{strings.ToLower(q.Name): {}}
+	pending := cnameTargets(msg.Answer, q.Name)
+
+	for steps := 0; len(pending) > 0; steps++ {
+		if steps >= maxCnameChainLength {
+			zi.qLog.Warn().Msgf("CNAME chain exceeded %d steps, not following further (%s)", maxCnameChainLength, q.Name)
+			return
+		}
+
+		target := pending[0]
+		pending = pending[1:]
+
+		if _, ok := seen[strings.ToLower(target)]; ok {
+			zi.qLog.Warn().Msgf("CNAME loop detected at %s (%s)", target, q.Name)
+			continue
+		}
+		seen[strings.ToLower(target)] = struct{}{}
+
+		zone, ok := zi.zoneLookup(target)
+		if !ok {
+			continue
+		}
+		res, ok := zone.HandleLocal(dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}, client, aliases)
+		if !ok {
+			continue
+		}
+
+		zi.qLog.Debug().Msgf("Followed CNAME to %s in zone %s (%s)", target, zone.Name, q.Name)
+		msg.Answer = append(msg.Answer, res.Answer...)
+		setSubnetScope(msg, subnetScope(res))
+		pending = append(pending, cnameTargets(res.Answer, target)...)
+	}
+}
+
+// cnameTargets returns the targets of all CNAME records owned by name
+func cnameTargets(rrs []dns.RR, name string) []string {
+	var targets []string
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+			targets = append(targets, cname.Target)
+		}
+	}
+	return targets
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestChaseCname(t *testing.T) {
+	srv := loadTestServer(t, `
+zones:
+  - name: example.com.
+    forwardEnabled: false
+    records:
+      A:
+        lb: [{address: 192.0.2.1}]
+      CNAME:
+        www: [{target: lb.example.com.}]
+        two: [{target: www.example.com.}]
+        other: [{target: app.other.test.}]
+        outside: [{target: www.example.net.}]
+        dangling: [{target: nope.example.com.}]
+        ping: [{target: pong.example.com.}]
+        pong: [{target: ping.example.com.}]
+        c0: [{target: c1.example.com.}]
+        c1: [{target: c2.example.com.}]
+        c2: [{target: c3.example.com.}]
+        c3: [{target: c4.example.com.}]
+        c4: [{target: c5.example.com.}]
+        c5: [{target: c6.example.com.}]
+        c6: [{target: c7.example.com.}]
+        c7: [{target: c8.example.com.}]
+        c8: [{target: c9.example.com.}]
+        c9: [{target: lb.example.com.}]
+  - name: other.test.
+    forwardEnabled: false
+    records:
+      AAAA:
+        app: [{address: "2001:db8::1"}]
+`)
+	zone := srv.zones["example.com."]
+
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer []string
+	}{
+		{
+			name:   "within the zone",
+			qname:  "www.example.com.",
+			qtype:  dns.TypeA,
+			answer: []string{"www.example.com. CNAME lb.example.com.", "lb.example.com. A 192.0.2.1"},
+		},
+		{
+			name:   "through two names",
+			qname:  "two.example.com.",
+			qtype:  dns.TypeA,
+			answer: []string{"two.example.com. CNAME www.example.com.", "www.example.com. CNAME lb.example.com.", "lb.example.com. A 192.0.2.1"},
+		},
+		{
+			name:   "across zones",
+			qname:  "other.example.com.",
+			qtype:  dns.TypeAAAA,
+			answer: []string{"other.example.com. CNAME app.other.test.", "app.other.test. AAAA 2001:db8::1"},
+		},
+		{
+			name:   "cname query is not chased",
+			qname:  "www.example.com.",
+			qtype:  dns.TypeCNAME,
+			answer: []string{"www.example.com. CNAME lb.example.com."},
+		},
+		{
+			name:   "target outside local zones",
+			qname:  "outside.example.com.",
+			qtype:  dns.TypeA,
+			answer: []string{"outside.example.com. CNAME www.example.net."},
+		},
+		{
+			name:   "target without records",
+			qname:  "dangling.example.com.",
+			qtype:  dns.TypeA,
+			answer: []string{"dangling.example.com. CNAME nope.example.com."},
+		},
+		{
+			name:   "loop",
+			qname:  "ping.example.com.",
+			qtype:  dns.TypeA,
+			answer: []string{"ping.example.com. CNAME pong.example.com.", "pong.example.com. CNAME ping.example.com."},
+		},
+		{
+			name:  "chain length cap",
+			qname: "c0.example.com.",
+			qtype: dns.TypeA,
+			answer: []string{
+				"c0.example.com. CNAME c1.example.com.",
+				"c1.example.com. CNAME c2.example.com.",
+				"c2.example.com. CNAME c3.example.com.",
+				"c3.example.com. CNAME c4.example.com.",
+				"c4.example.com. CNAME c5.example.com.",
+				"c5.example.com. CNAME c6.example.com.",
+				"c6.example.com. CNAME c7.example.com.",
+				"c7.example.com. CNAME c8.example.com.",
+				"c8.example.com. CNAME c9.example.com.",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := exchange(t, zone, new(dns.Msg).SetQuestion(tt.qname, tt.qtype), "192.0.2.10")
+			if res.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[res.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if !res.Authoritative {
+				t.Error("AA is not set")
+			}
+			if got := rrStrings(res.Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/henrikvtcodes/tungsten/config"
+	"github.com/henrikvtcodes/tungsten/util"
+	"github.com/miekg/dns"
+)
+
+// buildDelegations records the zone cuts: every name below the apex that owns NS records. Everything at or below a
+// cut belongs to the child zone, so this zone only ever answers for it with a referral.
+func (zi *ZoneInstance) buildDelegations() {
+	cuts := make(map[string]struct{})
+	if zi.StaticRecords != nil {
+		for key := range zi.StaticRecords.NS {
+			if key != config.ApexKey {
+				cuts[strings.ToLower(zi.ownerName(key))] = struct{}{}
+			}
+		}
+	}
+	zi.cuts = cuts
+}
+
+// zoneCut finds the zone cut that a name is at or below, if any. With nested cuts the one closest to the apex wins,
+// since the data below it (including the deeper NS records) is not this zone's.
+func (zi *ZoneInstance) zoneCut(name string) (string, bool) {
+	if len(zi.cuts) == 0 {
+		return "", false
+	}
+
+	apex := strings.ToLower(zi.Name)
+	name = strings.ToLower(name)
+	var (
+		cut   string
+		found bool
+	)
+	for name != apex && dns.IsSubDomain(apex, name) {
+		if _, ok := zi.cuts[name]; ok {
+			cut, found = name, true
+		}
+		parent, ok := parentName(name)
+		if !ok {
+			break
+		}
+		name = parent
+	}
+	return cut, found
+}
+
+// delegated reports whether a question is answered with a referral. DS records live on the parent side of a cut, so
+// those are still answered (negatively) by this zone.
+func (zi *ZoneInstance) delegated(q dns.Question) (string, bool) {
+	cut, ok := zi.zoneCut(q.Name)
+	if !ok || (q.Qtype == dns.TypeDS && strings.EqualFold(q.Name, cut)) {
+		return "", false
+	}
+	return cut, true
+}
+
+// HandleReferral answers a question for a delegated name with a non-authoritative referral: the NS records of the zone
+// cut in the authority section, along with glue for the nameservers that have A/AAAA records in this zone
+func (zi *ZoneInstance) HandleReferral(q dns.Question, client netip.Addr) (*dns.Msg, bool) {
+	cut, ok := zi.delegated(q)
+	if !ok {
+		return nil, false
+	}
+	recs := zi.StaticRecords.NS[zi.recordKey(cut)]
+	zi.qLog.Info().Msgf("Referring to delegation at %s (%s)", cut, q.Name)
+
+	msg := new(dns.Msg)
+	owner := zi.ownerName(zi.recordKey(cut))
+	var scope uint8
+	for _, rec := range recs {
+		msg.Ns = append(msg.Ns, util.NSRecord(owner, rec.Target, rec.TTL))
+		msg.Extra = append(msg.Extra, zi.glue(rec.Target, client, &scope)...)
+	}
+	msg.Extra = dns.Dedup(msg.Extra, nil)
+	setSubnetScope(msg, scope)
+	return msg, true
+}
+
+// glue returns the address records this zone holds for a nameserver, which may be occluded by the cut itself
+func (zi *ZoneInstance) glue(target string, client netip.Addr, scope *uint8) []dns.RR {
+	target = dns.Fqdn(target)
+	if !dns.IsSubDomain(zi.Name, target) {
+		return nil
+	}
+	key := zi.recordKey(target)
+
+	var rrs []dns.RR
+	for _, rec := range scopeRecords(zi.StaticRecords.A[key], client, scope) {
+		rrs = append(rrs, util.ARecord(target, net.ParseIP(rec.Address), rec.TTL))
+	}
+	for _, rec := range scopeRecords(zi.StaticRecords.AAAA[key], client, scope) {
+		rrs = append(rrs, util.AAAARecord(target, net.ParseIP(rec.Address), rec.TTL))
+	}
+	return rrs
+}
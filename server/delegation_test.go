@@ -0,0 +1,72 @@
+package server
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDelegation(t *testing.T) {
+	srv := loadTestServer(t, `
+zones:
+  - name: lab.
+    forwardEnabled: false
+    records:
+      SOA: {ns: ns.lab., mbox: hostmaster.lab.}
+      A:
+        www: [{address: 192.0.2.1}]
+        "*": [{address: 192.0.2.2}]
+        ns1.sub: [{address: 192.0.2.53}]
+        host.sub: [{address: 192.0.2.99}]
+      AAAA:
+        ns1.sub: [{address: "2001:db8::53"}]
+      NS:
+        sub: [{target: ns1.sub.lab.}, {target: ns.other.example.}]
+`)
+	zone := srv.zones["lab."]
+
+	referral := []string{"sub.lab. NS ns1.sub.lab.", "sub.lab. NS ns.other.example."}
+	glue := []string{"ns1.sub.lab. A 192.0.2.53", "ns1.sub.lab. AAAA 2001:db8::53"}
+	soa := []string{"lab. SOA ns.lab. hostmaster.lab. 1 7200 3600 1209600 3600"}
+
+	tests := []struct {
+		name          string
+		qname         string
+		qtype         uint16
+		rcode         int
+		authoritative bool
+		answer        []string
+		ns            []string
+		extra         []string
+	}{
+		{name: "below the cut", qname: "foo.sub.lab.", qtype: dns.TypeA, ns: referral, extra: glue},
+		{name: "ns at the cut", qname: "sub.lab.", qtype: dns.TypeNS, ns: referral, extra: glue},
+		{name: "occluded record", qname: "host.sub.lab.", qtype: dns.TypeA, ns: referral, extra: glue},
+		{name: "glue name", qname: "ns1.sub.lab.", qtype: dns.TypeA, ns: referral, extra: glue},
+		{name: "ds at the cut", qname: "sub.lab.", qtype: dns.TypeDS, authoritative: true, ns: soa},
+		{name: "above the cut", qname: "www.lab.", qtype: dns.TypeA, authoritative: true, answer: []string{"www.lab. A 192.0.2.1"}},
+		{name: "wildcard above the cut", qname: "other.lab.", qtype: dns.TypeA, authoritative: true, answer: []string{"other.lab. A 192.0.2.2"}},
+		{name: "no wildcard below the cut", qname: "other.sub.lab.", qtype: dns.TypeA, ns: referral, extra: glue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := exchange(t, zone, new(dns.Msg).SetQuestion(tt.qname, tt.qtype), "192.0.2.10")
+			if res.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[res.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if res.Authoritative != tt.authoritative {
+				t.Errorf("AA = %v, want %v", res.Authoritative, tt.authoritative)
+			}
+			if got := rrStrings(res.Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+			if got := rrStrings(res.Ns); !slices.Equal(got, tt.ns) {
+				t.Errorf("authority = %q, want %q", got, tt.ns)
+			}
+			if got := rrStrings(res.Extra); !slices.Equal(got, tt.extra) {
+				t.Errorf("additional = %q, want %q", got, tt.extra)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/henrikvtcodes/tungsten/config"
+	"github.com/henrikvtcodes/tungsten/util"
+	"github.com/miekg/dns"
+)
+
+const (
+	dnssdServicesKey = "_services._dns-sd._udp"
+	dnssdBrowseKey   = "b._dns-sd._udp"
+	dnssdLegacyKey   = "lb._dns-sd._udp"
+)
+
+// expandServices turns the DNS-SD service shortcuts of a zone into the PTR, SRV and TXT records browsers look for
+// (RFC 6763). The configured records are copied rather than modified.
+func (zi *ZoneInstance) expandServices(records *config.RecordsCollection, services []*config.ServiceConfig) *config.RecordsCollection {
+	if len(services) == 0 {
+		return records
+	}
+
+	rc := new(config.RecordsCollection)
+	if records != nil {
+		*rc = *records
+	}
+	rc.PTR = maps.Clone(rc.PTR)
+	rc.SRV = maps.Clone(rc.SRV)
+	rc.TXT = maps.Clone(rc.TXT)
+	if rc.PTR == nil {
+		rc.PTR = make(map[string][]config.PTRRecord)
+	}
+	if rc.SRV == nil {
+		rc.SRV = make(map[string][]config.SRVRecord)
+	}
+	if rc.TXT == nil {
+		rc.TXT = make(map[string][]config.TXTRecord)
+	}
+
+	addPTR := func(key string, target string, base config.BaseRecord) {
+		for _, existing := range rc.PTR[key] {
+			if strings.EqualFold(existing.Target, target) {
+				return
+			}
+		}
+		rc.PTR[key] = append(slices.Clip(rc.PTR[key]), config.PTRRecord{BaseRecord: base, Target: target})
+	}
+
+	for _, svc := range services {
+		base := svc.BaseRecord
+		serviceKey := "_" + strings.TrimPrefix(strings.ToLower(svc.Type), "_") + "._" + strings.TrimPrefix(strings.ToLower(svc.Protocol), "_")
+		instanceLabel := util.EscapeLabel(svc.Instance)
+		instanceKey := strings.ToLower(instanceLabel) + "." + serviceKey
+
+		host := svc.Host
+		if !dns.IsFqdn(host) {
+			host = zi.ownerName(strings.ToLower(host))
+		}
+
+		// Advertise this zone as a browsing domain, and the service type within it
+		addPTR(dnssdBrowseKey, zi.Name, base)
+		addPTR(dnssdLegacyKey, zi.Name, base)
+		addPTR(dnssdServicesKey, zi.ownerName(serviceKey), base)
+		addPTR(serviceKey, zi.ownerName(instanceLabel+"."+serviceKey), base)
+
+		rc.SRV[instanceKey] = append(slices.Clip(rc.SRV[instanceKey]), config.SRVRecord{
+			BaseRecord: base,
+			Target:     host,
+			Port:       svc.Port,
+			Priority:   svc.Priority,
+			Weight:     svc.Weight,
+		})
+
+		// DNS-SD requires a TXT record for every instance, even if it only holds a single empty string
+		txt := config.TXTRecord{BaseRecord: base}
+		for _, k := range slices.Sorted(maps.Keys(svc.TXT)) {
+			if v := svc.TXT[k]; v != "" {
+				txt.Strings = append(txt.Strings, k+"="+v)
+			} else {
+				txt.Strings = append(txt.Strings, k)
+			}
+		}
+		rc.TXT[instanceKey] = append(slices.Clip(rc.TXT[instanceKey]), txt)
+
+		zi.baseLog.Debug().Msgf("Expanded DNS-SD service %s", zi.ownerName(instanceLabel+"."+serviceKey))
+	}
+
+	return rc
+}
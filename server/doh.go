@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henrikvtcodes/tungsten/util"
+	"github.com/miekg/dns"
+)
+
+const (
+	dohPath        = "/dns-query"
+	dohContentType = "application/dns-message"
+)
+
+// bufferedResponseWriter adapts a single DoH or DoQ request to dns.ResponseWriter, so that it can be passed through
+// dnsServeMux like any other query
+type bufferedResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	res        *dns.Msg
+}
+
+func (hw *bufferedResponseWriter) LocalAddr() net.Addr  { return hw.localAddr }
+func (hw *bufferedResponseWriter) RemoteAddr() net.Addr { return hw.remoteAddr }
+
+func (hw *bufferedResponseWriter) WriteMsg(msg *dns.Msg) error {
+	hw.res = msg
+	return nil
+}
+
+func (hw *bufferedResponseWriter) Write(buf []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(buf); err != nil {
+		return 0, err
+	}
+	hw.res = msg
+	return len(buf), nil
+}
+
+func (hw *bufferedResponseWriter) Close() error        { return nil }
+func (hw *bufferedResponseWriter) TsigStatus() error   { return nil }
+func (hw *bufferedResponseWriter) TsigTimersOnly(bool) {}
+func (hw *bufferedResponseWriter) Hijack()             {}
+
+// serveHTTPSDNS runs DNS-over-HTTPS (RFC 8484) listeners on the server-wide bind addresses
+func (srv *Server) serveHTTPSDNS(ctx context.Context, wg *sync.WaitGroup) {
+	conf := srv.config.DNSConfig.DoH
+	addrs, err := srv.resolveBindAddresses(srv.config.DNSConfig.Bind, conf.Port)
+	if err != nil {
+		util.Logger.Err(err).Msg("Failed to resolve DNS-over-HTTPS bind addresses")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, srv.handleDoH)
+
+	for _, addr := range addrs {
+		hs := &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		if !conf.PlainHTTP {
+			hs.TLSConfig = srv.certs.TLSConfig("h2", "http/1.1")
+		}
+		go srv.runHTTPServer(ctx, wg, hs)
+	}
+}
+
+// runHTTPServer starts a DoH server and shuts it down once the context is cancelled
+func (srv *Server) runHTTPServer(ctx context.Context, wg *sync.WaitGroup, hs *http.Server) {
+	proto := "https"
+	if hs.TLSConfig == nil {
+		proto = "http"
+	}
+
+	wg.Add(1)
+	go func() {
+		util.Logger.Info().Str("net", proto).Str("addr", hs.Addr).Msg("Starting DNS server")
+		var hsErr error
+		if hs.TLSConfig != nil {
+			hsErr = hs.ListenAndServeTLS("", "")
+		} else {
+			hsErr = hs.ListenAndServe()
+		}
+		if hsErr != nil && !errors.Is(hsErr, http.ErrServerClosed) {
+			util.Logger.Err(hsErr).Str("net", proto).Str("addr", hs.Addr).Msg("Failed to start DNS server")
+		}
+	}()
+
+	<-ctx.Done()
+	util.Logger.Info().Str("net", proto).Str("addr", hs.Addr).Msg("Stopping DNS server")
+	defer wg.Done()
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer stopCancel()
+
+	if err := hs.Shutdown(stopCtx); err != nil {
+		util.Logger.Err(err).Str("net", proto).Str("addr", hs.Addr).Msg("Failed to shutdown DNS server")
+		return
+	}
+
+	util.Logger.Info().Str("net", proto).Str("addr", hs.Addr).Msg("Stopped DNS server")
+}
+
+// handleDoH decodes a DoH request, answers it through dnsServeMux and writes the response back
+func (srv *Server) handleDoH(w http.ResponseWriter, r *http.Request) {
+	req, err := readDoHRequest(r)
+	if err != nil {
+		util.Logger.Debug().Err(err).Str("client", r.RemoteAddr).Msg("Rejected DNS-over-HTTPS request")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hw := &bufferedResponseWriter{
+		localAddr:  tcpAddr(r.Context().Value(http.LocalAddrContextKey)),
+		remoteAddr: srv.dohClientAddr(r),
+	}
+	srv.dispatch(srv.dnsServeMux).ServeDNS(hw, req)
+	if hw.res == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	buf, err := hw.res.Pack()
+	if err != nil {
+		util.Logger.Err(err).Msg("Failed to pack DNS-over-HTTPS response")
+		http.Error(w, "failed to pack response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTtl(hw.res)))
+	_, _ = w.Write(buf)
+}
+
+// readDoHRequest decodes the DNS message from either a GET (base64url `dns` parameter) or POST request
+func readDoHRequest(r *http.Request) (*dns.Msg, error) {
+	var buf []byte
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, errors.New("missing dns query parameter")
+		}
+		var err error
+		if buf, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "=")); err != nil {
+			return nil, errors.New("invalid dns query parameter")
+		}
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != dohContentType {
+			return nil, fmt.Errorf("unsupported content type %q", ct)
+		}
+		var err error
+		if buf, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize)); err != nil {
+			return nil, errors.New("failed to read request body")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported method %s", r.Method)
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(buf); err != nil {
+		return nil, errors.New("invalid DNS message")
+	}
+	if len(msg.Question) != 1 {
+		return nil, errors.New("expected exactly one question")
+	}
+	return msg, nil
+}
+
+// dohClientAddr works out the client address. X-Forwarded-For is only used in plain HTTP mode for requests from a
+// trusted proxy, in which case the right-most address that is not a trusted proxy is the client.
+func (srv *Server) dohClientAddr(r *http.Request) net.Addr {
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+
+	doh := srv.config.DNSConfig.DoH
+	if doh == nil || !doh.PlainHTTP || !isTrustedProxy(doh.TrustedProxies, addrFromNet(remote)) {
+		return remote
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = &net.TCPAddr{IP: addr.Unmap().AsSlice()}
+		if !isTrustedProxy(doh.TrustedProxies, addr.Unmap()) {
+			break
+		}
+	}
+	return client
+}
+
+// isTrustedProxy reports whether an address belongs to one of the trusted proxy networks
+func isTrustedProxy(proxies []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// tcpAddr turns the local address of an HTTP connection into a TCP address, so upstream queries made on behalf of a
+// DoH client use TCP
+func tcpAddr(addr any) net.Addr {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a
+	}
+	return &net.TCPAddr{}
+}
+
+// minTtl returns the lowest TTL in a response, used as the HTTP cache lifetime
+func minTtl(msg *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
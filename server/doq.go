@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/henrikvtcodes/tungsten/util"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// DoQ error codes, from RFC 9250 section 4.3
+const (
+	doqNoError       = 0x0
+	doqInternalError = 0x1
+	doqProtocolError = 0x2
+)
+
+// doqStreamTimeout bounds how long a client may take to send its query on a stream
+const doqStreamTimeout = 10 * time.Second
+
+// serveQUICDNS runs DNS-over-QUIC (RFC 9250) listeners on the server-wide bind addresses
+func (srv *Server) serveQUICDNS(ctx context.Context, wg *sync.WaitGroup) {
+	addrs, err := srv.resolveBindAddresses(srv.config.DNSConfig.Bind, srv.config.DNSConfig.DoQ.Port)
+	if err != nil {
+		util.Logger.Err(err).Msg("Failed to resolve DNS-over-QUIC bind addresses")
+		return
+	}
+
+	for _, addr := range addrs {
+		go srv.runQUICServer(ctx, wg, addr)
+	}
+}
+
+// runQUICServer accepts DoQ connections on an address until the context is cancelled
+func (srv *Server) runQUICServer(ctx context.Context, wg *sync.WaitGroup, addr string) {
+	listener, err := quic.ListenAddr(addr, srv.certs.TLSConfig("doq"), &quic.Config{
+		MaxIdleTimeout: 30 * time.Second,
+		Allow0RTT:      false,
+	})
+	if err != nil {
+		util.Logger.Err(err).Str("net", "quic").Str("addr", addr).Msg("Failed to start DNS server")
+		return
+	}
+
+	wg.Add(1)
+	defer wg.Done()
+	util.Logger.Info().Str("net", "quic").Str("addr", addr).Msg("Starting DNS server")
+
+	var conns sync.WaitGroup
+	for {
+		conn, err := listener.Accept(ctx)
+		if err != nil {
+			break
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			srv.serveQUICConn(ctx, conn)
+		}()
+	}
+
+	util.Logger.Info().Str("net", "quic").Str("addr", addr).Msg("Stopping DNS server")
+	if err := listener.Close(); err != nil {
+		util.Logger.Err(err).Str("net", "quic").Str("addr", addr).Msg("Failed to shutdown DNS server")
+		return
+	}
+	conns.Wait()
+	util.Logger.Info().Str("net", "quic").Str("addr", addr).Msg("Stopped DNS server")
+}
+
+// serveQUICConn answers every stream opened on a DoQ connection, each of which carries exactly one query
+func (srv *Server) serveQUICConn(ctx context.Context, conn *quic.Conn) {
+	// Upstream queries made on behalf of DoQ clients use TCP, since responses are not size-limited like UDP
+	localAddr := &net.TCPAddr{}
+	if udpAddr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		localAddr = &net.TCPAddr{IP: udpAddr.IP, Port: udpAddr.Port, Zone: udpAddr.Zone}
+	}
+
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			_ = conn.CloseWithError(doqNoError, "")
+			return
+		}
+		go func() {
+			if err := srv.serveQUICStream(stream, localAddr, conn.RemoteAddr()); err != nil {
+				util.Logger.Debug().Err(err).Str("client", conn.RemoteAddr().String()).Msg("Closing DNS-over-QUIC connection")
+				_ = conn.CloseWithError(doqProtocolError, err.Error())
+			}
+		}()
+	}
+}
+
+// serveQUICStream reads a length-prefixed query from a stream, answers it through dnsServeMux and writes the response
+// back before closing the stream
+func (srv *Server) serveQUICStream(stream *quic.Stream, localAddr net.Addr, remoteAddr net.Addr) error {
+	_ = stream.SetDeadline(time.Now().Add(doqStreamTimeout))
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return errors.Join(errors.New("failed to read query length"), err)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		return errors.Join(errors.New("failed to read query"), err)
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil {
+		return errors.Join(errors.New("invalid DNS message"), err)
+	}
+	// RFC 9250 section 4.2.1 requires the message ID to be 0
+	if req.Id != 0 || len(req.Question) != 1 {
+		return errors.New("invalid DNS-over-QUIC query")
+	}
+
+	bw := &bufferedResponseWriter{localAddr: localAddr, remoteAddr: remoteAddr}
+	srv.dispatch(srv.dnsServeMux).ServeDNS(bw, req)
+	if bw.res == nil {
+		stream.CancelWrite(doqInternalError)
+		return nil
+	}
+
+	res, err := bw.res.Pack()
+	if err != nil {
+		util.Logger.Err(err).Msg("Failed to pack DNS-over-QUIC response")
+		stream.CancelWrite(doqInternalError)
+		return nil
+	}
+
+	out := make([]byte, 2, 2+len(res))
+	binary.BigEndian.PutUint16(out, uint16(len(res)))
+	if _, err := stream.Write(append(out, res...)); err != nil {
+		util.Logger.Debug().Err(err).Msg("Failed to write DNS-over-QUIC response")
+		return nil
+	}
+	_ = stream.Close()
+	return nil
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/henrikvtcodes/tungsten/config"
+	"github.com/miekg/dns"
+)
+
+// cgnatPrefix is the shared address space of RFC 6598 (also used by Tailscale), which is not publicly routable
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// ecsMode returns how the zone handles EDNS Client Subnet options towards its upstreams
+func (zi *ZoneInstance) ecsMode() string {
+	if zi.ForwardConfig == nil || zi.ForwardConfig.ECS == nil || zi.ForwardConfig.ECS.Mode == "" {
+		return config.ECSStrip
+	}
+	return zi.ForwardConfig.ECS.Mode
+}
+
+// applyECS returns the query with the EDNS Client Subnet option that should be sent upstream according to the ECS
+// mode. The client's query is copied before being modified, and returned as is if nothing changes.
+func (zi *ZoneInstance) applyECS(req *dns.Msg, client net.Addr) *dns.Msg {
+	if !zi.Forward {
+		return req
+	}
+	mode := zi.ecsMode()
+	subnet := requestSubnet(req)
+
+	switch mode {
+	case config.ECSStrip:
+		if subnet == nil {
+			return req
+		}
+		return withSubnet(req, nil)
+	case config.ECSPass, config.ECSSynthesize:
+		var prefix netip.Prefix
+		if subnet != nil {
+			addr, _ := netip.AddrFromSlice(subnet.Address)
+			prefix = netip.PrefixFrom(addr.Unmap(), int(subnet.SourceNetmask))
+		} else if mode == config.ECSSynthesize {
+			addr := addrFromNet(client)
+			if !isPublicAddr(addr) {
+				return req
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		} else {
+			return req
+		}
+		prefix = zi.trimPrefix(prefix)
+		if subnet != nil && prefix.Bits() == int(subnet.SourceNetmask) {
+			return req
+		}
+		return withSubnet(req, newSubnetOption(prefix))
+	}
+	return req
+}
+
+// trimPrefix shortens a client subnet to the prefix length configured for its address family
+func (zi *ZoneInstance) trimPrefix(prefix netip.Prefix) netip.Prefix {
+	bits := uint8(prefix.Bits())
+	limit := uint8(prefix.Addr().BitLen())
+	if ecs := zi.ForwardConfig.ECS; ecs != nil {
+		if prefix.Addr().Is4() {
+			limit = ecs.IPv4Prefix
+		} else {
+			limit = ecs.IPv6Prefix
+		}
+	}
+	if bits > limit {
+		bits = limit
+	}
+	trimmed, _ := prefix.Addr().Prefix(int(bits))
+	return trimmed
+}
+
+// requestSubnet returns the EDNS Client Subnet option of a message, if it has one
+func requestSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// newSubnetOption builds an EDNS Client Subnet option for a query
+func newSubnetOption(prefix netip.Prefix) *dns.EDNS0_SUBNET {
+	subnet := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(prefix.Bits()),
+		Address:       prefix.Addr().AsSlice(),
+	}
+	if prefix.Addr().Is4() {
+		subnet.Family = 1
+	} else {
+		subnet.Family = 2
+	}
+	return subnet
+}
+
+// withSubnet returns a copy of a query with its EDNS Client Subnet option replaced, or removed if subnet is nil
+func withSubnet(req *dns.Msg, subnet *dns.EDNS0_SUBNET) *dns.Msg {
+	req = req.Copy()
+	opt := req.IsEdns0()
+	if opt == nil {
+		if subnet == nil {
+			return req
+		}
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetUDPSize(dns.MinMsgSize)
+		req.Extra = append(req.Extra, opt)
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	if subnet != nil {
+		options = append(options, subnet)
+	}
+	opt.Option = options
+	return req
+}
+
+// finalizeSubnet makes the EDNS Client Subnet option of a response match the query (RFC 7871 section 7.2.1). Clients
+// that did not send one don't get one back, and the others get their own subnet echoed with the scope of the answer:
+// the upstream's, the subnet that local records were picked by, or 0 for answers that are the same for every client.
+func finalizeSubnet(req *dns.Msg, res *dns.Msg) {
+	opt := res.IsEdns0()
+	if opt == nil {
+		return
+	}
+	reqSubnet := requestSubnet(req)
+
+	var scope uint8
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			scope = max(scope, subnet.SourceScope)
+			continue
+		}
+		options = append(options, o)
+	}
+	if reqSubnet != nil {
+		options = append(options, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        reqSubnet.Family,
+			SourceNetmask: reqSubnet.SourceNetmask,
+			SourceScope:   min(scope, reqSubnet.SourceNetmask),
+			Address:       reqSubnet.Address,
+		})
+	}
+	opt.Option = options
+}
+
+// setSubnetScope records how many bits of the client address a local answer depends on, as the scope of an EDNS Client
+// Subnet option that finalizeSubnet turns into the echo of the client's own. The widest scope set is kept.
+func setSubnetScope(msg *dns.Msg, scope uint8) {
+	if msg == nil || scope == 0 {
+		return
+	}
+	if subnet := requestSubnet(msg); subnet != nil {
+		subnet.SourceScope = max(subnet.SourceScope, scope)
+		return
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		msg.Extra = append(msg.Extra, opt)
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, SourceScope: scope})
+}
+
+// subnetScope returns the scope set on an answer by setSubnetScope (or by an upstream)
+func subnetScope(msg *dns.Msg) uint8 {
+	if msg == nil {
+		return 0
+	}
+	if subnet := requestSubnet(msg); subnet != nil {
+		return subnet.SourceScope
+	}
+	return 0
+}
+
+// clientAddr is the address used to pick subnet-scoped records, and whether it was taken from the query's EDNS Client
+// Subnet option. That is only used if the query comes from one of the trusted networks, and the source address is used
+// otherwise.
+func clientAddr(req *dns.Msg, remote net.Addr, trusted []netip.Prefix) (netip.Addr, bool) {
+	source := addrFromNet(remote)
+	subnet := requestSubnet(req)
+	if subnet == nil {
+		return source, false
+	}
+	for _, prefix := range trusted {
+		if !prefix.Contains(source) {
+			continue
+		}
+		if addr, ok := netip.AddrFromSlice(subnet.Address); ok {
+			return addr.Unmap(), true
+		}
+		break
+	}
+	return source, false
+}
+
+// addrFromNet extracts the IP address of a network address
+func addrFromNet(addr net.Addr) netip.Addr {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		if addr == nil {
+			return netip.Addr{}
+		}
+		if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+			return ap.Addr().Unmap()
+		}
+		return netip.Addr{}
+	}
+	parsed, _ := netip.AddrFromSlice(ip)
+	return parsed.Unmap()
+}
+
+// isPublicAddr reports whether an address is publicly routable, so that it is worth telling upstreams about
+func isPublicAddr(addr netip.Addr) bool {
+	return addr.IsValid() && addr.IsGlobalUnicast() && !addr.IsPrivate() && !cgnatPrefix.Contains(addr)
+}
+
+// scopeRecords picks the records for a client: those scoped to the most specific subnet containing it, or otherwise
+// the ones without any subnets. scope is widened to the number of client address bits the choice depends on: the
+// prefix length of the matching subnet, all of them if the client is in none of the subnets, or 0 if none are set.
+func scopeRecords[T interface{ Scope() []netip.Prefix }](recs []T, client netip.Addr, scope *uint8) []T {
+	scoped := false
+	for _, rec := range recs {
+		if len(rec.Scope()) > 0 {
+			scoped = true
+			break
+		}
+	}
+	if !scoped {
+		return recs
+	}
+
+	var (
+		best     []T
+		bestBits = -1
+		global   []T
+	)
+	for _, rec := range recs {
+		if len(rec.Scope()) == 0 {
+			global = append(global, rec)
+			continue
+		}
+		bits := -1
+		for _, prefix := range rec.Scope() {
+			if client.IsValid() && prefix.Contains(client) && prefix.Bits() > bits {
+				bits = prefix.Bits()
+			}
+		}
+		if bits < 0 {
+			continue
+		}
+		if bits > bestBits {
+			best, bestBits = nil, bits
+		}
+		if bits == bestBits {
+			best = append(best, rec)
+		}
+	}
+	if bestBits >= 0 {
+		*scope = max(*scope, uint8(bestBits))
+		return best
+	}
+	*scope = max(*scope, uint8(client.BitLen()))
+	return global
+}
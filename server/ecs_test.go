@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// withClientSubnet adds an EDNS Client Subnet option to a query
+func withClientSubnet(req *dns.Msg, subnet string) *dns.Msg {
+	_, ipNet, _ := net.ParseCIDR(subnet)
+	bits, _ := ipNet.Mask.Size()
+	req.SetEdns0(ednsUDPSize, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(bits), Address: ipNet.IP.To4()})
+	return req
+}
+
+func TestSubnetScopedRecords(t *testing.T) {
+	srv := loadTestServer(t, `
+zones:
+  - name: example.com.
+    forwardEnabled: false
+    trustedEcsClients: [127.0.0.0/8]
+    records:
+      A:
+        www:
+          - {address: 192.0.2.1}
+          - {address: 10.0.0.1, subnets: [198.51.100.0/24]}
+          - {address: 10.0.1.1, subnets: [198.51.100.128/25]}
+        scoped:
+          - {address: 10.0.0.2, subnets: [198.51.100.0/24]}
+        plain: [{address: 192.0.2.2}]
+      CNAME:
+        alias: [{target: www.example.com.}]
+`)
+	zone := srv.zones["example.com."]
+
+	tests := []struct {
+		name   string
+		qname  string
+		client string
+		subnet string
+		rcode  int
+		answer []string
+		// scope is the echoed scope prefix length, or -1 if no client subnet should be echoed
+		scope int
+	}{
+		{name: "source address", qname: "www.example.com.", client: "198.51.100.7", answer: []string{"www.example.com. A 10.0.0.1"}, scope: -1},
+		{name: "most specific subnet", qname: "www.example.com.", client: "198.51.100.200", answer: []string{"www.example.com. A 10.0.1.1"}, scope: -1},
+		{name: "global fallback", qname: "www.example.com.", client: "192.0.2.10", answer: []string{"www.example.com. A 192.0.2.1"}, scope: -1},
+		{name: "trusted subnet", qname: "www.example.com.", client: "127.0.0.1", subnet: "198.51.100.0/24", answer: []string{"www.example.com. A 10.0.0.1"}, scope: 24},
+		{name: "trusted narrower subnet", qname: "www.example.com.", client: "127.0.0.1", subnet: "198.51.100.128/28", answer: []string{"www.example.com. A 10.0.1.1"}, scope: 25},
+		{name: "trusted subnet outside scopes", qname: "www.example.com.", client: "127.0.0.1", subnet: "203.0.113.0/24", answer: []string{"www.example.com. A 192.0.2.1"}, scope: 24},
+		{name: "untrusted subnet", qname: "www.example.com.", client: "192.0.2.10", subnet: "198.51.100.0/24", answer: []string{"www.example.com. A 192.0.2.1"}, scope: 0},
+		{name: "unscoped name", qname: "plain.example.com.", client: "127.0.0.1", subnet: "198.51.100.0/24", answer: []string{"plain.example.com. A 192.0.2.2"}, scope: 0},
+		{name: "through cname", qname: "alias.example.com.", client: "127.0.0.1", subnet: "198.51.100.0/24", answer: []string{"alias.example.com. CNAME www.example.com.", "www.example.com. A 10.0.0.1"}, scope: 24},
+		{name: "scoped nodata", qname: "scoped.example.com.", client: "127.0.0.1", subnet: "203.0.113.0/24", scope: 24},
+		{name: "nxdomain", qname: "nope.example.com.", client: "127.0.0.1", subnet: "198.51.100.0/24", rcode: dns.RcodeNameError, scope: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg).SetQuestion(tt.qname, dns.TypeA)
+			if tt.subnet != "" {
+				withClientSubnet(req, tt.subnet)
+			}
+			res := exchange(t, zone, req, tt.client)
+			if res.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[res.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if got := rrStrings(res.Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+
+			subnet := requestSubnet(res)
+			switch {
+			case tt.scope < 0 && subnet != nil:
+				t.Errorf("unexpected client subnet %v", subnet)
+			case tt.scope >= 0 && subnet == nil:
+				t.Error("client subnet was not echoed")
+			case subnet != nil:
+				if want := requestSubnet(req); subnet.SourceNetmask != want.SourceNetmask || !net.IP(subnet.Address).Equal(want.Address) {
+					t.Errorf("echoed subnet %v, want %v", subnet, want)
+				}
+				if int(subnet.SourceScope) != tt.scope {
+					t.Errorf("scope = %d, want %d", subnet.SourceScope, tt.scope)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"github.com/henrikvtcodes/tungsten/config"
+	"github.com/miekg/dns"
+)
+
+// ednsUDPSize is the UDP payload size advertised to clients and upstreams, as recommended by DNS Flag Day 2020
+const ednsUDPSize = 1232
+
+// populateEDNSOptions reads the allowlist of EDNS0 options that get passed on to upstreams
+func (zi *ZoneInstance) populateEDNSOptions() error {
+	zi.ednsOptions = make(map[uint16]struct{})
+	if zi.ForwardConfig == nil {
+		return nil
+	}
+	for _, name := range zi.ForwardConfig.EDNSOptions {
+		code, err := config.ParseEDNSOption(name)
+		if err != nil {
+			return err
+		}
+		zi.ednsOptions[code] = struct{}{}
+	}
+	return nil
+}
+
+// forwardRequest builds the query sent to upstreams from a client query, keeping its flags, DO bit, client subnet and
+// allowed EDNS0 options. The upstream gets our own buffer size, since truncated responses are retried over TCP anyway.
+func (zi *ZoneInstance) forwardRequest(q *dns.Msg) *dns.Msg {
+	fwReq := new(dns.Msg)
+	fwReq.SetQuestion(q.Question[0].Name, q.Question[0].Qtype)
+	fwReq.Question[0].Qclass = q.Question[0].Qclass
+	fwReq.RecursionDesired = q.RecursionDesired
+	fwReq.CheckingDisabled = q.CheckingDisabled
+	fwReq.AuthenticatedData = q.AuthenticatedData
+
+	opt := q.IsEdns0()
+	if opt == nil {
+		return fwReq
+	}
+
+	fwOpt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	fwOpt.SetUDPSize(ednsUDPSize)
+	fwOpt.SetDo(opt.Do())
+	for _, o := range opt.Option {
+		// The client subnet has already been set up by applyECS according to the ECS mode
+		if _, ok := zi.ednsOptions[o.Option()]; ok || o.Option() == dns.EDNS0SUBNET {
+			fwOpt.Option = append(fwOpt.Option, o)
+		}
+	}
+	fwReq.Extra = append(fwReq.Extra, fwOpt)
+	return fwReq
+}
+
+// finalizeReply turns a response into a proper reply to the client's query. The ID, question and RD/CD flags come from
+// the query, the OPT record matches whether the client used EDNS0, and UDP responses are truncated to fit the client's
+// buffer size.
+func finalizeReply(req *dns.Msg, res *dns.Msg, reqNet string) {
+	// SetReply resets the rcode, so make sure that NXDOMAIN, SERVFAIL, etc are kept
+	rcode := res.Rcode
+	res.SetReply(req)
+	res.Rcode = rcode
+
+	reqOpt := req.IsEdns0()
+	do := reqOpt != nil && reqOpt.Do()
+
+	// RFC 6840 section 5.8: only set AD for clients that asked for it
+	if !req.AuthenticatedData && !do {
+		res.AuthenticatedData = false
+	}
+
+	if reqOpt == nil {
+		// Clients without EDNS0 must not get an OPT record back (RFC 6891 section 7), and cannot see extended rcodes
+		extra := res.Extra[:0]
+		for _, rr := range res.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		res.Extra = extra
+		if res.Rcode > 0xF {
+			res.Rcode = dns.RcodeServerFailure
+		}
+	} else {
+		opt := res.IsEdns0()
+		if opt == nil {
+			opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+			res.Extra = append(res.Extra, opt)
+		}
+		finalizeSubnet(req, res)
+		opt.SetVersion(0)
+		opt.SetUDPSize(ednsUDPSize)
+		opt.SetDo(do)
+	}
+
+	if reqNet == "udp" {
+		size := dns.MinMsgSize
+		if reqOpt != nil {
+			size = int(reqOpt.UDPSize())
+		}
+		res.Truncate(size)
+	}
+}
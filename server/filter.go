@@ -0,0 +1,391 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/henrikvtcodes/tungsten/config"
+	"github.com/henrikvtcodes/tungsten/util"
+	"github.com/miekg/dns"
+)
+
+const (
+	// filterFetchTimeout caps how long downloading a single list may take
+	filterFetchTimeout = 30 * time.Second
+	// filterMaxListSize is the largest list that will be read, as a safeguard against huge or endless downloads
+	filterMaxListSize = 64 << 20
+)
+
+// hostsLocalNames are the entries found at the top of most hosts files, which must not be blocked
+var hostsLocalNames = map[string]struct{}{
+	"localhost.": {}, "localhost.localdomain.": {}, "local.": {}, "broadcasthost.": {}, "ip6-localhost.": {},
+	"ip6-loopback.": {}, "ip6-localnet.": {}, "ip6-mcastprefix.": {}, "ip6-allnodes.": {}, "ip6-allrouters.": {},
+	"ip6-allhosts.": {}, "0.0.0.0.": {},
+}
+
+// domainSet matches names exactly, together with all of their subdomains (suffix), or only their subdomains (below).
+// Lookups walk the labels of a name, so they take a few map lookups per label no matter how many rules there are.
+type domainSet struct {
+	exact  map[string]struct{}
+	suffix map[string]struct{}
+	below  map[string]struct{}
+}
+
+func newDomainSet() *domainSet {
+	return &domainSet{exact: make(map[string]struct{}), suffix: make(map[string]struct{}), below: make(map[string]struct{})}
+}
+
+// Match reports whether a (lowercase, fully qualified) name is in the set
+func (ds *domainSet) Match(name string) bool {
+	if _, ok := ds.exact[name]; ok {
+		return true
+	}
+	if len(ds.suffix) == 0 && len(ds.below) == 0 {
+		return false
+	}
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := ds.suffix[name[off:]]; ok {
+			return true
+		}
+		if _, ok := ds.below[name[off:]]; ok && off > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// size is the number of rules in the set
+func (ds *domainSet) size() int {
+	return len(ds.exact) + len(ds.suffix) + len(ds.below)
+}
+
+// merge adds the rules of another set to this one
+func (ds *domainSet) merge(other *domainSet) {
+	for name := range other.exact {
+		ds.exact[name] = struct{}{}
+	}
+	for name := range other.suffix {
+		ds.suffix[name] = struct{}{}
+	}
+	for name := range other.below {
+		ds.below[name] = struct{}{}
+	}
+}
+
+// filterList is a parsed list. ABP exception rules (`@@||example.com^`) end up in allow even on blocklists.
+type filterList struct {
+	block *domainSet
+	allow *domainSet
+}
+
+// parseFilterList reads a list in hosts, AdGuard/ABP or plain domain format, which may be mixed line by line.
+// Unsupported rules (ie ABP rules with modifiers or cosmetic filters) are skipped.
+func parseFilterList(r io.Reader) (*filterList, error) {
+	list := &filterList{block: newDomainSet(), allow: newDomainSet()}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[") {
+			continue
+		}
+		list.addRule(line)
+	}
+	return list, scanner.Err()
+}
+
+// addRule adds a single rule from a list
+func (fl *filterList) addRule(line string) {
+	// AdGuard/ABP syntax, where `||` blocks the domain and its subdomains
+	if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||") {
+		set := fl.block
+		if rest, ok := strings.CutPrefix(line, "@@"); ok {
+			set = fl.allow
+			line = rest
+		}
+		line = strings.TrimPrefix(line, "||")
+		domain, ok := strings.CutSuffix(line, "^")
+		if !ok || strings.ContainsAny(domain, "/*$|") {
+			return
+		}
+		if name, ok := filterName(domain); ok {
+			set.suffix[name] = struct{}{}
+		}
+		return
+	}
+
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+
+	// Hosts format, where every name following the address is blocked
+	if _, err := netip.ParseAddr(fields[0]); err == nil {
+		for _, field := range fields[1:] {
+			name, ok := filterName(field)
+			if _, local := hostsLocalNames[name]; ok && !local {
+				fl.block.exact[name] = struct{}{}
+			}
+		}
+		return
+	}
+
+	// Plain domain lists, where `*.` blocks only the subdomains
+	if len(fields) != 1 {
+		return
+	}
+	if domain, ok := strings.CutPrefix(fields[0], "*."); ok {
+		if name, ok := filterName(domain); ok {
+			fl.block.below[name] = struct{}{}
+		}
+		return
+	}
+	if name, ok := filterName(fields[0]); ok {
+		fl.block.exact[name] = struct{}{}
+	}
+}
+
+// filterName normalizes a domain from a list, reporting false if it is not a valid name
+func filterName(domain string) (string, bool) {
+	name := dns.Fqdn(strings.ToLower(strings.TrimSpace(domain)))
+	if name == "." || strings.Contains(name, "*") {
+		return "", false
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", false
+	}
+	return name, true
+}
+
+// filterRules is a complete set of rules, swapped out as a whole whenever the lists are loaded
+type filterRules struct {
+	block *domainSet
+	allow *domainSet
+}
+
+// add merges a list into the rules. Every rule on an allowlist allows names, no matter its syntax.
+func (fr *filterRules) add(list *filterList, allowlist bool) {
+	if allowlist {
+		fr.allow.merge(list.block)
+	} else {
+		fr.block.merge(list.block)
+	}
+	fr.allow.merge(list.allow)
+}
+
+// Blocked reports whether a name is blocked and not allowed
+func (fr *filterRules) Blocked(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	return fr.block.Match(name) && !fr.allow.Match(name)
+}
+
+// Filter blocks queries for names on blocklists. The lists are loaded in the background once it is started, and then
+// refreshed periodically.
+type Filter struct {
+	conf  *config.FilterConfig
+	rules atomic.Pointer[filterRules]
+
+	// sources keeps the last good contents of each list, for when it fails to load again
+	mu      sync.Mutex
+	sources map[string]*filterList
+
+	httpClient *http.Client
+	stop       chan struct{}
+}
+
+// NewFilter creates the filter for a config, or returns nil if filtering is disabled. It does not load any lists, so
+// until Start is called it uses the config's own rules along with the lists that prev had loaded.
+func NewFilter(conf *config.FilterConfig, prev *Filter) *Filter {
+	if conf == nil || !conf.Enabled {
+		return nil
+	}
+	f := &Filter{
+		conf:       conf,
+		sources:    make(map[string]*filterList),
+		httpClient: &http.Client{Timeout: filterFetchTimeout},
+		stop:       make(chan struct{}),
+	}
+	if prev != nil {
+		prev.mu.Lock()
+		for source, list := range prev.sources {
+			f.sources[source] = list
+		}
+		prev.mu.Unlock()
+	}
+
+	f.rules.Store(f.buildRules(f.cachedSource))
+	return f
+}
+
+// Start loads the lists in the background, and keeps refreshing them until the filter is closed
+func (f *Filter) Start() {
+	if f == nil {
+		return
+	}
+	go func() {
+		f.Load()
+		if interval := f.conf.RefreshInterval; interval != nil && *interval > 0 {
+			f.refresh(time.Duration(*interval) * time.Second)
+		}
+	}()
+}
+
+// Load reads every list and swaps in the new rules
+func (f *Filter) Load() {
+	rules := f.buildRules(f.loadSource)
+	f.rules.Store(rules)
+	util.Logger.Info().Int("blocked", rules.block.size()).Int("allowed", rules.allow.size()).Msg("Loaded filter lists")
+}
+
+// buildRules combines the config's own rules with the lists returned by load
+func (f *Filter) buildRules(load func(source string) (*filterList, bool)) *filterRules {
+	rules := &filterRules{block: newDomainSet(), allow: newDomainSet()}
+
+	block := &filterList{block: newDomainSet(), allow: newDomainSet()}
+	for _, rule := range f.conf.Block {
+		block.addRule(rule)
+	}
+	rules.add(block, false)
+	allow := &filterList{block: newDomainSet(), allow: newDomainSet()}
+	for _, rule := range f.conf.Allow {
+		allow.addRule(rule)
+	}
+	rules.add(allow, true)
+
+	for _, source := range f.conf.Blocklists {
+		if list, ok := load(source); ok {
+			rules.add(list, false)
+		}
+	}
+	for _, source := range f.conf.Allowlists {
+		if list, ok := load(source); ok {
+			rules.add(list, true)
+		}
+	}
+	return rules
+}
+
+// cachedSource returns the last good contents of a list without loading it
+func (f *Filter) cachedSource(source string) (*filterList, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list, ok := f.sources[source]
+	return list, ok
+}
+
+// loadSource reads and parses a single list, falling back to its last good contents if that fails
+func (f *Filter) loadSource(source string) (*filterList, bool) {
+	list, err := f.fetchSource(source)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil {
+		prev, ok := f.sources[source]
+		util.Logger.Warn().Err(err).Str("source", source).Bool("usingPrevious", ok).Msg("Failed to load filter list")
+		return prev, ok
+	}
+	f.sources[source] = list
+	return list, true
+}
+
+// fetchSource reads a list from an http(s) URL or a local file
+func (f *Filter) fetchSource(source string) (*filterList, error) {
+	var r io.Reader
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		res, err := f.httpClient.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %s", res.Status)
+		}
+		r = res.Body
+	} else {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r, filterMaxListSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > filterMaxListSize {
+		return nil, errors.New("list is too large")
+	}
+	return parseFilterList(bytes.NewReader(buf))
+}
+
+// refresh reloads the lists periodically until the filter is closed
+func (f *Filter) refresh(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.Load()
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// Close stops refreshing the lists
+func (f *Filter) Close() {
+	if f != nil {
+		close(f.stop)
+	}
+}
+
+// Handle answers a question for a blocked name with the configured response
+func (f *Filter) Handle(q dns.Question) (*dns.Msg, bool) {
+	if !f.rules.Load().Blocked(q.Name) {
+		return nil, false
+	}
+
+	msg := new(dns.Msg)
+	if f.conf.Response == config.FilterNXDomain {
+		msg.Rcode = dns.RcodeNameError
+		return msg, true
+	}
+
+	ipv4, ipv6 := net.IPv4zero, net.IPv6zero
+	if f.conf.Response == config.FilterSinkhole {
+		ipv4, ipv6 = net.ParseIP(f.conf.SinkholeIPv4), net.ParseIP(f.conf.SinkholeIPv6)
+	}
+	// Other types, and sinkholes without an address of the family, get an empty answer
+	switch {
+	case q.Qtype == dns.TypeA && ipv4 != nil:
+		msg.Answer = append(msg.Answer, util.ARecord(q.Name, ipv4, f.conf.TTL))
+	case q.Qtype == dns.TypeAAAA && ipv6 != nil:
+		msg.Answer = append(msg.Answer, util.AAAARecord(q.Name, ipv6, f.conf.TTL))
+	}
+	return msg, true
+}
+
+// zoneFilter returns the filter a zone should use, which is nil if the zone has opted out
+func zoneFilter(filter *Filter, conf *config.ZoneConfig) *Filter {
+	if filter == nil || conf.NoFilter {
+		return nil
+	}
+	return filter
+}
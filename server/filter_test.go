@@ -0,0 +1,128 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFilterList(t *testing.T) {
+	const list = `! AdGuard style comment
+# hosts style comment
+[Adblock Plus 2.0]
+0.0.0.0 ads.example.com tracker.example.com # trailing comment
+127.0.0.1 localhost
+::1 ip6-localhost
+||doubleclick.example^
+@@||safe.doubleclick.example^
+||has.modifier.example^$third-party
+example.org/path
+plain.example.net
+*.wild.example.net
+Mixed.Case.Example
+`
+	fl, err := parseFilterList(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		blocked bool
+		allowed bool
+	}{
+		{name: "ads.example.com.", blocked: true},
+		{name: "tracker.example.com.", blocked: true},
+		{name: "sub.ads.example.com.", blocked: false},
+		{name: "localhost.", blocked: false},
+		{name: "ip6-localhost.", blocked: false},
+		{name: "doubleclick.example.", blocked: true},
+		{name: "ad.doubleclick.example.", blocked: true},
+		{name: "safe.doubleclick.example.", blocked: true, allowed: true},
+		{name: "has.modifier.example.", blocked: false},
+		{name: "example.org.", blocked: false},
+		{name: "plain.example.net.", blocked: true},
+		{name: "www.plain.example.net.", blocked: false},
+		{name: "wild.example.net.", blocked: false},
+		{name: "a.wild.example.net.", blocked: true},
+		{name: "a.b.wild.example.net.", blocked: true},
+		{name: "mixed.case.example.", blocked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fl.block.Match(tt.name); got != tt.blocked {
+				t.Errorf("block.Match = %v, want %v", got, tt.blocked)
+			}
+			if got := fl.allow.Match(tt.name); got != tt.allowed {
+				t.Errorf("allow.Match = %v, want %v", got, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestDomainSetMatch(t *testing.T) {
+	ds := newDomainSet()
+	ds.exact["exact.example."] = struct{}{}
+	ds.suffix["suffix.example."] = struct{}{}
+	ds.below["below.example."] = struct{}{}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "exact.example.", want: true},
+		{name: "sub.exact.example.", want: false},
+		{name: "suffix.example.", want: true},
+		{name: "sub.suffix.example.", want: true},
+		{name: "a.b.suffix.example.", want: true},
+		{name: "notsuffix.example.", want: false},
+		{name: "below.example.", want: false},
+		{name: "sub.below.example.", want: true},
+		{name: "example.", want: false},
+		{name: ".", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ds.Match(tt.name); got != tt.want {
+				t.Errorf("Match(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterRulesAllowlistPrecedence(t *testing.T) {
+	blocklist, err := parseFilterList(strings.NewReader("||ads.example^\n@@||ok.ads.example^\n0.0.0.0 tracker.example\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every rule on an allowlist allows names, whatever its syntax
+	allowlist, err := parseFilterList(strings.NewReader("tracker.example\n||cdn.ads.example^\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := &filterRules{block: newDomainSet(), allow: newDomainSet()}
+	rules.add(blocklist, false)
+	rules.add(allowlist, true)
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "ads.example.", want: true},
+		{name: "x.ads.example.", want: true},
+		{name: "ok.ads.example.", want: false},
+		{name: "x.ok.ads.example.", want: false},
+		{name: "cdn.ads.example.", want: false},
+		{name: "img.cdn.ads.example.", want: false},
+		{name: "tracker.example.", want: false},
+		{name: "TRACKER.example", want: false},
+		{name: "ADS.example", want: true},
+		{name: "other.example.", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules.Blocked(tt.name); got != tt.want {
+				t.Errorf("Blocked(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
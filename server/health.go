@@ -0,0 +1,204 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/henrikvtcodes/tungsten/config"
+	"github.com/henrikvtcodes/tungsten/util"
+	"github.com/henrikvtcodes/tungsten/util/roundrobin"
+	"github.com/miekg/dns"
+)
+
+// rttSmoothing is the weight of the newest sample in an upstream's moving average RTT
+const rttSmoothing = 0.3
+
+// upstreamHealth tracks how an upstream has been doing, from both forwarded queries and health probes
+type upstreamHealth struct {
+	failures     atomic.Uint32
+	ejectedUntil atomic.Int64
+	// rtt holds the float64 bits of the exponentially weighted moving average RTT, in seconds
+	rtt atomic.Uint64
+}
+
+func (h *upstreamHealth) ejected(now time.Time) bool {
+	return now.UnixNano() < h.ejectedUntil.Load()
+}
+
+func (h *upstreamHealth) avgRtt() float64 {
+	return math.Float64frombits(h.rtt.Load())
+}
+
+// UpstreamPool picks which of a zone's upstreams to ask, according to the configured strategy and their health
+type UpstreamPool struct {
+	zone      string
+	upstreams []*Upstream
+	rr        *roundrobin.RoundRobin[Upstream]
+
+	Strategy    string
+	maxFailures uint32
+	ejectTime   time.Duration
+
+	promMetrics *util.DNSMetrics
+	stopProbes  context.CancelFunc
+}
+
+func NewUpstreamPool(zone string, conf *config.ForwardConfig, upstreams []*Upstream, metrics *util.DNSMetrics) (*UpstreamPool, error) {
+	rr, err := roundrobin.New(upstreams...)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &UpstreamPool{
+		zone:        zone,
+		upstreams:   upstreams,
+		rr:          rr,
+		Strategy:    conf.Strategy,
+		maxFailures: max(conf.MaxFailures, 1),
+		ejectTime:   time.Duration(conf.EjectTime) * time.Second,
+		promMetrics: metrics,
+	}
+	for _, up := range upstreams {
+		pool.promMetrics.SetUpstreamHealthy(zone, up.String(), true)
+	}
+
+	if hc := conf.HealthCheck; hc != nil && hc.Enabled {
+		ctx, cancel := context.WithCancel(context.Background())
+		pool.stopProbes = cancel
+		go pool.runProbes(ctx, hc)
+	}
+
+	return pool, nil
+}
+
+// Order returns every upstream in the order they should be tried. Healthy upstreams are ordered by the strategy, and
+// ejected ones come last so that they are still used when nothing else works.
+func (p *UpstreamPool) Order() []*Upstream {
+	now := time.Now()
+	var healthy, ejected []*Upstream
+	for _, up := range p.upstreams {
+		if up.health.ejected(now) {
+			ejected = append(ejected, up)
+		} else {
+			healthy = append(healthy, up)
+		}
+	}
+
+	switch p.Strategy {
+	case config.StrategyRandom:
+		rand.Shuffle(len(healthy), func(i, j int) { healthy[i], healthy[j] = healthy[j], healthy[i] })
+	case config.StrategyLowestLatency:
+		slices.SortStableFunc(healthy, func(a, b *Upstream) int {
+			return cmp.Compare(a.health.avgRtt(), b.health.avgRtt())
+		})
+	case config.StrategySequential, config.StrategyParallel:
+		// Keep the configured order
+	default:
+		// Start from the next upstream in the rotation, then go through the rest in order
+		next := p.rr.Next()
+		if i := slices.Index(healthy, next); i > 0 {
+			healthy = append(healthy[i:], healthy[:i]...)
+		}
+	}
+
+	return append(healthy, ejected...)
+}
+
+// Healthy returns the upstreams that are not currently ejected, or all of them if every one is
+func (p *UpstreamPool) Healthy() []*Upstream {
+	now := time.Now()
+	var healthy []*Upstream
+	for _, up := range p.upstreams {
+		if !up.health.ejected(now) {
+			healthy = append(healthy, up)
+		}
+	}
+	if len(healthy) == 0 {
+		return p.upstreams
+	}
+	return healthy
+}
+
+// RecordSuccess folds an RTT into the upstream's moving average and brings it back into rotation if it was ejected
+func (p *UpstreamPool) RecordSuccess(up *Upstream, rtt time.Duration) {
+	p.promMetrics.ObserveUpstreamRtt(p.zone, up.String(), rtt)
+
+	for {
+		old := up.health.rtt.Load()
+		avg := math.Float64frombits(old)
+		if avg == 0 {
+			avg = rtt.Seconds()
+		} else {
+			avg = rttSmoothing*rtt.Seconds() + (1-rttSmoothing)*avg
+		}
+		if up.health.rtt.CompareAndSwap(old, math.Float64bits(avg)) {
+			break
+		}
+	}
+
+	up.health.failures.Store(0)
+	if up.health.ejectedUntil.Swap(0) != 0 {
+		util.Logger.Info().Str("zone", p.zone).Msgf("Upstream %s is healthy again", up)
+		p.promMetrics.SetUpstreamHealthy(p.zone, up.String(), true)
+	}
+}
+
+// RecordFailure counts a failed query or probe, ejecting the upstream once it has failed too many times in a row
+func (p *UpstreamPool) RecordFailure(up *Upstream) {
+	p.promMetrics.CountUpstreamFailure(p.zone, up.String())
+
+	if up.health.failures.Add(1) < p.maxFailures {
+		return
+	}
+	up.health.failures.Store(0)
+	now := time.Now()
+	if prev := up.health.ejectedUntil.Swap(now.Add(p.ejectTime).UnixNano()); prev < now.UnixNano() {
+		util.Logger.Warn().Str("zone", p.zone).Msgf("Ejecting upstream %s for %s after %d failures", up, p.ejectTime, p.maxFailures)
+		p.promMetrics.SetUpstreamHealthy(p.zone, up.String(), false)
+	}
+}
+
+// runProbes queries every upstream on an interval until the pool is closed
+func (p *UpstreamPool) runProbes(ctx context.Context, conf *config.HealthCheckConfig) {
+	ticker := time.NewTicker(time.Duration(max(conf.Interval, 1)) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, up := range p.upstreams {
+				go p.probe(up, conf.Name)
+			}
+		}
+	}
+}
+
+func (p *UpstreamPool) probe(up *Upstream, name string) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), dns.TypeNS)
+
+	res, rtt, err := up.Exchange(req, "udp")
+	if err != nil || res.Rcode == dns.RcodeServerFailure {
+		util.Logger.Debug().Str("zone", p.zone).Err(err).Msgf("Health probe to upstream %s failed", up)
+		p.RecordFailure(up)
+		return
+	}
+	p.RecordSuccess(up, rtt)
+}
+
+// Close stops the health probes and closes idle upstream connections
+func (p *UpstreamPool) Close() {
+	if p.stopProbes != nil {
+		p.stopProbes()
+	}
+	for _, up := range p.upstreams {
+		up.Close()
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+
+	"github.com/henrikvtcodes/tungsten/util"
+	"github.com/henrikvtcodes/tungsten/util/bind"
+	"github.com/miekg/dns"
+)
+
+// dnsListener is a UDP and TCP DNS server pair on a single address, with its own mux holding only the zones that are
+// supposed to answer on that address
+type dnsListener struct {
+	addr   string
+	mux    *dns.ServeMux
+	zones  map[string]struct{}
+	cancel context.CancelFunc
+}
+
+// resolveBindAddresses turns bind IPs and interface names into the list of addresses to listen on
+func (srv *Server) resolveBindAddresses(binds []string, port uint16) ([]string, error) {
+	ips, err := bind.ListBindIP(binds)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses to bind to found for %v", binds)
+	}
+
+	var addrs []string
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip, strconv.Itoa(int(port))))
+	}
+	slices.Sort(addrs)
+	return slices.Compact(addrs), nil
+}
+
+// populateListeners adds, updates and removes listeners to match the zones that should answer on each address. The
+// listener addresses of views are listened on as well, even if no zone of the default view is bound to them. This must
+// be called with configMu held.
+func (srv *Server) populateListeners(zones map[string]*ZoneInstance, viewAddrs []string) error {
+	desired, globalZones, err := srv.listenerZones(zones)
+	if err != nil {
+		return err
+	}
+	for _, addr := range viewAddrs {
+		if desired[addr] == nil {
+			desired[addr] = make(map[string]*ZoneInstance)
+		}
+	}
+
+	syncMux(srv.dnsServeMux, srv.globalZones, globalZones)
+
+	for addr, l := range srv.listeners {
+		if _, ok := desired[addr]; !ok {
+			util.Logger.Info().Str("addr", addr).Msg("Removing DNS listener")
+			if l.cancel != nil {
+				l.cancel()
+			}
+			delete(srv.listeners, addr)
+		}
+	}
+
+	for addr, addrZones := range desired {
+		l, ok := srv.listeners[addr]
+		if !ok {
+			l = &dnsListener{addr: addr, mux: dns.NewServeMux(), zones: make(map[string]struct{})}
+			srv.listeners[addr] = l
+		}
+		syncMux(l.mux, l.zones, addrZones)
+		if !ok && srv.runCtx != nil {
+			srv.startListener(l)
+		}
+	}
+
+	return nil
+}
+
+// listenerZones works out which zones answer on which addresses. Zones without their own bind setting use the
+// server-wide one, and are also the ones returned as the global zones (served by dnsServeMux). Since a wildcard bind
+// address also receives the queries to every specific address, the global zones are added to the listeners of zones
+// bound to an address that a wildcard covers; otherwise the more specific listener would refuse them.
+func (srv *Server) listenerZones(zones map[string]*ZoneInstance) (map[string]map[string]*ZoneInstance, map[string]*ZoneInstance, error) {
+	globalAddrs, err := srv.resolveBindAddresses(srv.config.DNSConfig.Bind, srv.config.DNSConfig.Port)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	desired := make(map[string]map[string]*ZoneInstance)
+	globalZones := make(map[string]*ZoneInstance)
+	for name, zi := range zones {
+		addrs := globalAddrs
+		if len(zi.Bind) > 0 {
+			addrs, err = srv.resolveBindAddresses(zi.Bind, srv.config.DNSConfig.Port)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to resolve bind addresses for zone %s: %w", name, err)
+			}
+		} else {
+			globalZones[name] = zi
+		}
+		for _, addr := range addrs {
+			if desired[addr] == nil {
+				desired[addr] = make(map[string]*ZoneInstance)
+			}
+			desired[addr][name] = zi
+		}
+	}
+
+	for addr, addrZones := range desired {
+		if slices.Contains(globalAddrs, addr) || !wildcardCovers(globalAddrs, addr) {
+			continue
+		}
+		for name, zi := range globalZones {
+			addrZones[name] = zi
+		}
+	}
+	return desired, globalZones, nil
+}
+
+// wildcardCovers reports whether one of the listen addresses is a wildcard on the same port that also receives queries
+// sent to addr. The IPv6 wildcard is dual-stack, so it covers IPv4 addresses as well.
+func wildcardCovers(listenAddrs []string, addr string) bool {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return false
+	}
+	for _, listenAddr := range listenAddrs {
+		wildcard, err := netip.ParseAddrPort(listenAddr)
+		if err != nil || !wildcard.Addr().IsUnspecified() || wildcard.Port() != ap.Port() {
+			continue
+		}
+		if wildcard.Addr().Is6() || ap.Addr().Unmap().Is4() {
+			return true
+		}
+	}
+	return false
+}
+
+// syncMux registers and unregisters zones on a mux so that it ends up serving exactly the desired zones
+func syncMux(mux *dns.ServeMux, registered map[string]struct{}, desired map[string]*ZoneInstance) {
+	for name := range registered {
+		if _, ok := desired[name]; !ok {
+			mux.HandleRemove(name)
+			delete(registered, name)
+		}
+	}
+	for name, zi := range desired {
+		if _, ok := registered[name]; !ok {
+			mux.Handle(name, zi)
+			registered[name] = struct{}{}
+		}
+	}
+}
+
+// startListener runs the UDP and TCP servers for a listener until either it is removed or the server stops
+func (srv *Server) startListener(l *dnsListener) {
+	ctx, cancel := context.WithCancel(srv.runCtx)
+	l.cancel = cancel
+	go srv.servePlainDNS(ctx, &srv.dnsWg, "udp", l.addr, srv.dispatch(l.mux))
+	go srv.servePlainDNS(ctx, &srv.dnsWg, "tcp", l.addr, srv.dispatch(l.mux))
+}
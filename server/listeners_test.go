@@ -0,0 +1,132 @@
+package server
+
+import (
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestListenerZones(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+		want map[string][]string
+	}{
+		{
+			name: "specific addresses",
+			conf: `
+bind: [127.0.0.1]
+zones:
+  - name: global.test.
+  - name: bound.test.
+    bind: [127.0.0.2]
+  - name: both.test.
+    bind: [127.0.0.1, 127.0.0.3]
+`,
+			want: map[string][]string{
+				"127.0.0.1:53": {"both.test.", "global.test."},
+				"127.0.0.2:53": {"bound.test."},
+				"127.0.0.3:53": {"both.test."},
+			},
+		},
+		{
+			name: "ipv4 wildcard",
+			conf: `
+bind: [0.0.0.0]
+zones:
+  - name: global.test.
+  - name: bound.test.
+    bind: [10.0.0.5]
+  - name: bound6.test.
+    bind: ["fd00::5"]
+`,
+			want: map[string][]string{
+				"0.0.0.0:53":   {"global.test."},
+				"10.0.0.5:53":  {"bound.test.", "global.test."},
+				"[fd00::5]:53": {"bound6.test."},
+			},
+		},
+		{
+			name: "dual-stack wildcard",
+			conf: `
+bind: ["::"]
+zones:
+  - name: global.test.
+  - name: bound.test.
+    bind: [10.0.0.5, "fd00::5"]
+`,
+			want: map[string][]string{
+				"[::]:53":      {"global.test."},
+				"10.0.0.5:53":  {"bound.test.", "global.test."},
+				"[fd00::5]:53": {"bound.test.", "global.test."},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := loadTestServer(t, tt.conf)
+			desired, _, err := srv.listenerZones(srv.zones)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string][]string)
+			for addr, zones := range desired {
+				got[addr] = slices.Sorted(maps.Keys(zones))
+			}
+			if !maps.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenerMuxes(t *testing.T) {
+	srv := loadTestServer(t, `
+bind: [0.0.0.0]
+zones:
+  - name: global.test.
+    forwardEnabled: false
+    records:
+      A:
+        www: [{address: 192.0.2.1}]
+  - name: bound.test.
+    forwardEnabled: false
+    bind: [10.0.0.5]
+    records:
+      A:
+        www: [{address: 192.0.2.2}]
+  - name: other.test.
+    forwardEnabled: false
+    bind: [10.0.0.6]
+    records:
+      A:
+        www: [{address: 192.0.2.3}]
+`)
+	tests := []struct {
+		addr  string
+		qname string
+		rcode int
+	}{
+		{addr: "0.0.0.0:53", qname: "www.global.test.", rcode: dns.RcodeSuccess},
+		{addr: "0.0.0.0:53", qname: "www.bound.test.", rcode: dns.RcodeRefused},
+		{addr: "10.0.0.5:53", qname: "www.bound.test.", rcode: dns.RcodeSuccess},
+		{addr: "10.0.0.5:53", qname: "www.global.test.", rcode: dns.RcodeSuccess},
+		{addr: "10.0.0.5:53", qname: "www.other.test.", rcode: dns.RcodeRefused},
+		{addr: "10.0.0.6:53", qname: "www.other.test.", rcode: dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr+" "+tt.qname, func(t *testing.T) {
+			l, ok := srv.listeners[tt.addr]
+			if !ok {
+				t.Fatalf("no listener on %s", tt.addr)
+			}
+			res := exchange(t, l.mux, new(dns.Msg).SetQuestion(tt.qname, dns.TypeA), "192.0.2.10")
+			if res.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[res.Rcode], dns.RcodeToString[tt.rcode])
+			}
+		})
+	}
+}
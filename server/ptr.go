@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/henrikvtcodes/tungsten/util"
+	"github.com/miekg/dns"
+)
+
+// AddressOwner is a forward name that points at an address, used to synthesize PTR records
+type AddressOwner struct {
+	Name string
+	TTL  uint32
+}
+
+// ReverseLookup finds every forward name across the local zones that points at an address
+type ReverseLookup func(addr netip.Addr) []AddressOwner
+
+// buildAddressIndex maps the addresses of this zone's static A/AAAA records to their owner names. Wildcards are skipped
+// since they do not have a single name to point back to.
+func (zi *ZoneInstance) buildAddressIndex() {
+	index := make(map[netip.Addr][]AddressOwner)
+
+	if rc := zi.StaticRecords; rc != nil {
+		for key, recs := range rc.A {
+			if strings.Contains(key, "*") {
+				continue
+			}
+			for _, rec := range recs {
+				if addr, err := netip.ParseAddr(rec.Address); err == nil {
+					index[addr] = append(index[addr], AddressOwner{Name: zi.ownerName(key), TTL: rec.TTL})
+				}
+			}
+		}
+		for key, recs := range rc.AAAA {
+			if strings.Contains(key, "*") {
+				continue
+			}
+			for _, rec := range recs {
+				if addr, err := netip.ParseAddr(rec.Address); err == nil {
+					index[addr] = append(index[addr], AddressOwner{Name: zi.ownerName(key), TTL: rec.TTL})
+				}
+			}
+		}
+	}
+
+	zi.addresses = index
+}
+
+// AddressOwners returns the names in this zone that point at an address, from both static records and Tailscale
+// machines (which live in 100.64.0.0/10 and fd7a:115c:a1e0::/48)
+func (zi *ZoneInstance) AddressOwners(addr netip.Addr) []AddressOwner {
+	owners := append([]AddressOwner(nil), zi.addresses[addr]...)
+
+	if zi.Tailscale != nil && zi.TSClient != nil {
+		for _, machine := range zi.TSClient.FindMachinesByIP(net.IP(addr.AsSlice())) {
+			owners = append(owners, AddressOwner{
+				Name: machine + zi.Tailscale.MachineSubdomain + zi.Name,
+				TTL:  zi.Tailscale.MachineTtl,
+			})
+		}
+	}
+
+	return owners
+}
+
+// HandleAutoPTR answers PTR queries in a reverse zone by looking up the forward records of all other local zones
+func (zi *ZoneInstance) HandleAutoPTR(q dns.Question) (*dns.Msg, bool) {
+	if q.Qtype != dns.TypePTR || zi.reverseLookup == nil {
+		return nil, false
+	}
+
+	zi.qLog.Debug().Msgf("Handling query with automatic PTR records (%s)", q.Name)
+	addr, ok := util.ParseReverseAddr(q.Name)
+	if !ok {
+		return nil, false
+	}
+
+	var answers []dns.RR
+	for _, owner := range zi.reverseLookup(addr) {
+		answers = append(answers, util.PTRRecord(q.Name, owner.Name, owner.TTL))
+	}
+	if len(answers) == 0 {
+		return nil, false
+	}
+
+	zi.qLog.Info().Msgf("Handled query with automatic PTR records (%s)", q.Name)
+	msg := new(dns.Msg)
+	msg.Authoritative = true
+	msg.Answer = answers
+	return msg, true
+}
+
+// autoPTRNameExists checks whether a reverse name points at an address that some local zone has a record for
+func (zi *ZoneInstance) autoPTRNameExists(name string) bool {
+	if !zi.AutoPTR || zi.reverseLookup == nil {
+		return false
+	}
+	addr, ok := util.ParseReverseAddr(name)
+	return ok && len(zi.reverseLookup(addr)) > 0
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henrikvtcodes/tungsten/config"
+	"github.com/henrikvtcodes/tungsten/util"
+	"github.com/miekg/dns"
+)
+
+// rateLimitSweepInterval is how often buckets that have filled back up are forgotten, so idle clients don't use memory
+const rateLimitSweepInterval = time.Minute
+
+// rateLimitAction is what happens to a response after response rate limiting
+type rateLimitAction int
+
+const (
+	rateLimitAllow rateLimitAction = iota
+	// rateLimitSlip sends an empty truncated response instead, so legitimate clients can retry over TCP
+	rateLimitSlip
+	rateLimitDrop
+)
+
+// tokenBucket holds up to burst tokens, which are refilled at a fixed rate and used up by queries or responses
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// limited counts the responses that were rate limited, to pick which ones get slipped
+	limited uint32
+}
+
+// take refills the bucket for the time that passed and takes a token, reporting false if there were none left
+func (b *tokenBucket) take(now time.Time, rate float64, burst float64) bool {
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rrlKey groups identical responses to a client network. Errors and NXDOMAIN responses are grouped by zone rather than
+// by name, so that queries for random names cannot get around the limit.
+type rrlKey struct {
+	client netip.Prefix
+	name   string
+	qtype  uint16
+	rcode  int
+}
+
+// RateLimiter applies per-client query limits and response rate limiting (RRL)
+type RateLimiter struct {
+	conf *config.RateLimitConfig
+
+	mu        sync.Mutex
+	queries   map[netip.Prefix]*tokenBucket
+	responses map[rrlKey]*tokenBucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter returns a rate limiter for the config, or nil if rate limiting is disabled
+func NewRateLimiter(conf *config.RateLimitConfig) *RateLimiter {
+	if conf == nil || !conf.Enabled {
+		return nil
+	}
+	return &RateLimiter{
+		conf:      conf,
+		queries:   make(map[netip.Prefix]*tokenBucket),
+		responses: make(map[rrlKey]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// clientNet returns the network a client address is grouped into, or false if the client is exempt
+func (rl *RateLimiter) clientNet(addr netip.Addr) (netip.Prefix, bool) {
+	addr = addr.Unmap()
+	if !addr.IsValid() {
+		return netip.Prefix{}, false
+	}
+	for _, prefix := range rl.conf.Exempt {
+		if prefix.Contains(addr) {
+			return netip.Prefix{}, false
+		}
+	}
+	bits := rl.conf.IPv6Prefix
+	if addr.Is4() {
+		bits = rl.conf.IPv4Prefix
+	}
+	prefix, _ := addr.Prefix(int(bits))
+	return prefix, true
+}
+
+// AllowQuery takes a token from the client network's query bucket, reporting false if the client is over its limit
+func (rl *RateLimiter) AllowQuery(client netip.Addr) bool {
+	if rl == nil || rl.conf.QueriesPerSecond == 0 {
+		return true
+	}
+	prefix, ok := rl.clientNet(client)
+	if !ok {
+		return true
+	}
+
+	rate, burst := float64(rl.conf.QueriesPerSecond), rl.queryBurst()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	rl.sweep(now)
+
+	b, ok := rl.queries[prefix]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		rl.queries[prefix] = b
+	}
+	return b.take(now, rate, burst)
+}
+
+// LimitResponse decides whether a response to a client may be sent, slipped or dropped
+func (rl *RateLimiter) LimitResponse(client netip.Addr, zone string, res *dns.Msg) rateLimitAction {
+	if rl == nil || rl.conf.ResponsesPerSecond == 0 || len(res.Question) == 0 {
+		return rateLimitAllow
+	}
+	prefix, ok := rl.clientNet(client)
+	if !ok {
+		return rateLimitAllow
+	}
+
+	key := rrlKey{client: prefix, name: strings.ToLower(zone), qtype: res.Question[0].Qtype, rcode: res.Rcode}
+	if res.Rcode == dns.RcodeSuccess {
+		key.name = strings.ToLower(res.Question[0].Name)
+	}
+	rate := float64(rl.conf.ResponsesPerSecond)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	rl.sweep(now)
+
+	b, ok := rl.responses[key]
+	if !ok {
+		b = &tokenBucket{tokens: rate, last: now}
+		rl.responses[key] = b
+	}
+	if b.take(now, rate, rate) {
+		return rateLimitAllow
+	}
+
+	b.limited++
+	if slip := rl.conf.Slip; slip != nil && *slip > 0 && b.limited%*slip == 0 {
+		return rateLimitSlip
+	}
+	return rateLimitDrop
+}
+
+// queryBurst is how many queries a client network may send at once, which defaults to a second's worth
+func (rl *RateLimiter) queryBurst() float64 {
+	if rl.conf.Burst == 0 {
+		return float64(rl.conf.QueriesPerSecond)
+	}
+	return float64(rl.conf.Burst)
+}
+
+// sweep forgets the buckets that would have filled back up by now, since they are the same as new ones. This must be
+// called with mu held.
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	rl.lastSweep = now
+
+	for prefix, b := range rl.queries {
+		if b.tokens+now.Sub(b.last).Seconds()*float64(rl.conf.QueriesPerSecond) >= rl.queryBurst() {
+			delete(rl.queries, prefix)
+		}
+	}
+	for key, b := range rl.responses {
+		if b.tokens+now.Sub(b.last).Seconds()*float64(rl.conf.ResponsesPerSecond) >= float64(rl.conf.ResponsesPerSecond) {
+			delete(rl.responses, key)
+		}
+	}
+}
+
+// limitQuery applies the query limit of a rate limiter, returning false if the query is over it. Limited UDP queries
+// are dropped, while other transports get REFUSED since their source address cannot be spoofed.
+func limitQuery(rl *RateLimiter, w dns.ResponseWriter, req *dns.Msg, zone string, metrics *util.DNSMetrics) bool {
+	if rl.AllowQuery(addrFromNet(w.RemoteAddr())) {
+		return true
+	}
+	metrics.CountRateLimitDrop(zone, "query")
+
+	reqNet := w.LocalAddr().Network()
+	util.Logger.Debug().Str("zone", zone).Str("client", w.RemoteAddr().String()).Msgf("Query over rate limit (%s)", req.Question[0].Name)
+	if reqNet == "udp" {
+		return false
+	}
+	res := new(dns.Msg)
+	res.Rcode = dns.RcodeRefused
+	finalizeReply(req, res, reqNet)
+	_ = w.WriteMsg(res)
+	return false
+}
+
+// limitResponse applies response rate limiting to a finished UDP response, returning false if it should not be sent.
+// Slipped responses are emptied and truncated in place.
+func (zi *ZoneInstance) limitResponse(w dns.ResponseWriter, res *dns.Msg) bool {
+	if zi.responseLimiter == nil || w.LocalAddr().Network() != "udp" {
+		return true
+	}
+
+	switch zi.responseLimiter.LimitResponse(addrFromNet(w.RemoteAddr()), zi.Name, res) {
+	case rateLimitSlip:
+		zi.promMetrics.CountRateLimitSlip(zi.Name)
+		res.Answer, res.Ns = nil, nil
+		opt := res.IsEdns0()
+		res.Extra = nil
+		if opt != nil {
+			res.Extra = append(res.Extra, opt)
+		}
+		res.Truncated = true
+		return true
+	case rateLimitDrop:
+		zi.promMetrics.CountRateLimitDrop(zi.Name, "response")
+		return false
+	}
+	return true
+}
+
+// zoneResponseLimiter returns the limiter used for a zone's response rate limiting, preferring the zone's own
+func (srv *Server) zoneResponseLimiter(zi *ZoneInstance) *RateLimiter {
+	if zi.rateLimiter != nil {
+		return zi.rateLimiter
+	}
+	return srv.rateLimiter
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/henrikvtcodes/tungsten/config"
+	"github.com/miekg/dns"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	start := time.Unix(0, 0)
+	tests := []struct {
+		name   string
+		tokens float64
+		after  time.Duration
+		rate   float64
+		burst  float64
+		want   bool
+		left   float64
+	}{
+		{name: "full", tokens: 5, rate: 1, burst: 5, want: true, left: 4},
+		{name: "empty", tokens: 0, rate: 1, burst: 5, want: false, left: 0},
+		{name: "partly refilled", tokens: 0, after: 500 * time.Millisecond, rate: 1, burst: 5, want: false, left: 0.5},
+		{name: "refilled", tokens: 0.5, after: 500 * time.Millisecond, rate: 1, burst: 5, want: true, left: 0},
+		{name: "capped at burst", tokens: 1, after: time.Hour, rate: 10, burst: 3, want: true, left: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &tokenBucket{tokens: tt.tokens, last: start}
+			if got := b.take(start.Add(tt.after), tt.rate, tt.burst); got != tt.want {
+				t.Errorf("take = %v, want %v", got, tt.want)
+			}
+			if b.tokens != tt.left {
+				t.Errorf("tokens = %v, want %v", b.tokens, tt.left)
+			}
+		})
+	}
+}
+
+func TestRateLimiterLimitResponse(t *testing.T) {
+	slip := func(n uint32) *uint32 { return &n }
+	tests := []struct {
+		name    string
+		slip    *uint32
+		exempt  bool
+		allowed int
+		slipped int
+		dropped int
+	}{
+		{name: "no slip", slip: nil, allowed: 2, dropped: 8},
+		{name: "slip 0 drops all", slip: slip(0), allowed: 2, dropped: 8},
+		{name: "slip 1 truncates all", slip: slip(1), allowed: 2, slipped: 8},
+		{name: "slip 2", slip: slip(2), allowed: 2, slipped: 4, dropped: 4},
+		{name: "slip 3", slip: slip(3), allowed: 2, slipped: 2, dropped: 6},
+		{name: "exempt", slip: slip(2), exempt: true, allowed: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &config.RateLimitConfig{Enabled: true, ResponsesPerSecond: 2, Slip: tt.slip, IPv4Prefix: 24, IPv6Prefix: 56}
+			if tt.exempt {
+				conf.Exempt = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+			}
+			rl := NewRateLimiter(conf)
+
+			res := new(dns.Msg)
+			res.SetQuestion("www.example.com.", dns.TypeA)
+			var allowed, slipped, dropped int
+			for range 10 {
+				switch rl.LimitResponse(netip.MustParseAddr("192.0.2.1"), "example.com.", res) {
+				case rateLimitAllow:
+					allowed++
+				case rateLimitSlip:
+					slipped++
+				case rateLimitDrop:
+					dropped++
+				}
+			}
+			if allowed != tt.allowed || slipped != tt.slipped || dropped != tt.dropped {
+				t.Errorf("allowed/slipped/dropped = %d/%d/%d, want %d/%d/%d", allowed, slipped, dropped, tt.allowed, tt.slipped, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestRateLimiterResponseKeys(t *testing.T) {
+	rl := NewRateLimiter(&config.RateLimitConfig{Enabled: true, ResponsesPerSecond: 1, IPv4Prefix: 24, IPv6Prefix: 56})
+	response := func(name string, rcode int) *dns.Msg {
+		res := new(dns.Msg)
+		res.SetQuestion(name, dns.TypeA)
+		res.Rcode = rcode
+		return res
+	}
+	client := netip.MustParseAddr("192.0.2.1")
+
+	tests := []struct {
+		name   string
+		client netip.Addr
+		res    *dns.Msg
+		want   rateLimitAction
+	}{
+		{name: "first answer", client: client, res: response("a.example.com.", dns.RcodeSuccess), want: rateLimitAllow},
+		{name: "same answer", client: client, res: response("a.example.com.", dns.RcodeSuccess), want: rateLimitDrop},
+		{name: "same answer other case", client: client, res: response("A.example.com.", dns.RcodeSuccess), want: rateLimitDrop},
+		{name: "other name", client: client, res: response("b.example.com.", dns.RcodeSuccess), want: rateLimitAllow},
+		{name: "same client network", client: netip.MustParseAddr("192.0.2.200"), res: response("a.example.com.", dns.RcodeSuccess), want: rateLimitDrop},
+		{name: "other client network", client: netip.MustParseAddr("198.51.100.1"), res: response("a.example.com.", dns.RcodeSuccess), want: rateLimitAllow},
+		{name: "first nxdomain", client: client, res: response("x.example.com.", dns.RcodeNameError), want: rateLimitAllow},
+		{name: "nxdomain for another name", client: client, res: response("y.example.com.", dns.RcodeNameError), want: rateLimitDrop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rl.LimitResponse(tt.client, "example.com.", tt.res); got != tt.want {
+				t.Errorf("LimitResponse = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io/fs"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -37,9 +38,25 @@ type Server struct {
 	tailscaleClient *tailscale.Tailscale
 
 	// dns stuff
-	dnsWg       sync.WaitGroup
+	dnsWg sync.WaitGroup
+	// runCtx is set once the server is running, so that listeners added by a reload can be started
+	runCtx context.Context
+	// dnsServeMux serves the zones that do not have their own bind setting
 	dnsServeMux *dns.ServeMux
-	zones       map[string]*ZoneInstance
+	globalZones map[string]struct{}
+	listeners   map[string]*dnsListener
+	// zones make up the default view, which answers the clients that no other view matches
+	zones map[string]*ZoneInstance
+	views []*view
+
+	// Certificate shared by the encrypted transports, reloaded along with the config
+	certs *certificateStore
+	// Response cache shared by all zones, recreated (and so emptied) on reload since upstreams may have changed
+	cache *ResponseCache
+	// Server-wide rate limits, applied before a query reaches any zone
+	rateLimiter *RateLimiter
+	// Blocklists shared by all zones, reloaded along with the config
+	filter *Filter
 
 	// prometheus metrics
 	promRegistry *prometheus.Registry
@@ -51,6 +68,9 @@ func NewServer(conf *config.WrappedServerConfig) *Server {
 		config:      conf,
 		zones:       make(map[string]*ZoneInstance),
 		dnsServeMux: dns.NewServeMux(),
+		globalZones: make(map[string]struct{}),
+		listeners:   make(map[string]*dnsListener),
+		certs:       new(certificateStore),
 		promMetrics: util.NewDNSMetrics(),
 	}
 	err := srv.populateConfig()
@@ -67,6 +87,10 @@ func NewMockServer(conf *config.WrappedServerConfig) error {
 		config:      conf,
 		zones:       make(map[string]*ZoneInstance),
 		dnsServeMux: dns.NewServeMux(),
+		globalZones: make(map[string]struct{}),
+		listeners:   make(map[string]*dnsListener),
+		certs:       new(certificateStore),
+		promMetrics: util.NewDNSMetrics(),
 	}
 	err := srv.populateConfig()
 	if err != nil {
@@ -84,9 +108,55 @@ func (srv *Server) populateConfig() error {
 		srv.tailscaleClient = new(tailscale.Tailscale)
 	}
 
+	srv.cache = NewResponseCache(srv.config.DNSConfig.Cache)
+	srv.rateLimiter = NewRateLimiter(srv.config.DNSConfig.RateLimit)
+	// The filter keeps the previously loaded lists while the new ones load in the background, so this never blocks on
+	// downloading them. Before the server runs (ie when only validating the config) nothing is downloaded at all.
+	prevFilter := srv.filter
+	srv.filter = NewFilter(srv.config.DNSConfig.Filter, prevFilter)
+	prevFilter.Close()
+	if srv.runCtx != nil {
+		srv.filter.Start()
+	}
+	activeZones, err := srv.loadZones(srv.zones, srv.config.DNSConfig.Zones, srv.lookupZone, srv.reverseLookup, srv.cache)
+	if err != nil {
+		return err
+	}
+	activeViews, viewAddrs, err := srv.populateViews()
+	if err != nil {
+		return err
+	}
+
+	// Make sure every zone is being served on the right addresses before old zones are stopped
+	if err := srv.populateListeners(activeZones, viewAddrs); err != nil {
+		return err
+	}
+	if err := srv.populateCertificates(); err != nil {
+		return err
+	}
+
+	prevZones := slicesx.MapKeys(srv.zones)
+	currZones := slicesx.MapKeys(activeZones)
+	for _, z := range prevZones {
+		if slices.Index(currZones, z) == -1 {
+			srv.zones[z].Stop()
+			util.Logger.Info().Msgf("Removing zone %s", z)
+		}
+	}
+
+	srv.zones = activeZones
+	srv.stopRemovedViews(activeViews)
+	srv.views = activeViews
+
+	return nil
+}
+
+// loadZones creates or reinitializes the zones of a view. Existing zones are reused so that their handlers stay
+// registered while hot-reloading, and the ones that are no longer configured are left for the caller to stop.
+func (srv *Server) loadZones(prev map[string]*ZoneInstance, confs []*config.ZoneConfig, lookup ZoneLookup, reverse ReverseLookup, cache *ResponseCache) (map[string]*ZoneInstance, error) {
 	activeZones := make(map[string]*ZoneInstance)
 
-	for _, conf := range srv.config.DNSConfig.Zones {
+	for _, conf := range confs {
 		// If the zone does not have a forward configOld and is set up to forward queries, use the default forward configOld
 		if conf.ForwardEnabled && conf.ForwardConfig == nil {
 			conf.ForwardConfig = srv.config.DNSConfig.DefaultForwardConfig
@@ -94,28 +164,36 @@ func (srv *Server) populateConfig() error {
 
 		// Some general validation logic
 		if !strings.HasSuffix(conf.Name, ".") {
-			return fmt.Errorf("zone name must end with a period character (%s)", conf.Name)
+			return nil, fmt.Errorf("zone name must end with a period character (%s)", conf.Name)
 		}
 		if strings.HasPrefix(conf.Name, ".") && len(conf.Name) > 1 {
-			return fmt.Errorf("zone name must not start with a period character (%s)", conf.Name)
+			return nil, fmt.Errorf("zone name must not start with a period character (%s)", conf.Name)
+		}
+		if conf.AutoPTR && !util.IsReverseZone(conf.Name) {
+			return nil, fmt.Errorf("autoPtr can only be enabled on reverse zones under in-addr.arpa. or ip6.arpa. (%s)", conf.Name)
 		}
 
 		// Determine whether we are hot-reloading an existing zone or not
 		util.Logger.Debug().Str("zone", conf.Name).Msg("Loading config")
-		if zi, ok := srv.zones[conf.Name]; ok {
+		if zi, ok := prev[conf.Name]; ok {
 			// Reinitialize existing zone
 			util.Logger.Debug().Str("zone", conf.Name).Msg("Found zone, initializing with new config")
 			err := zi.Initialize(*conf)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if zi.Tailscale != nil && zi.TSClient == nil {
 				util.Logger.Debug().Str("zone", conf.Name).Msg("Enabling Tailscale")
-				srv.zones[conf.Name].TSClient = srv.tailscaleClient
+				zi.TSClient = srv.tailscaleClient
 			} else if zi.Tailscale == nil && zi.TSClient != nil {
 				util.Logger.Debug().Str("zone", conf.Name).Msg("Disabling Tailscale")
-				srv.zones[conf.Name].TSClient = nil
+				zi.TSClient = nil
 			}
+			zi.zoneLookup = lookup
+			zi.reverseLookup = reverse
+			zi.cache = zoneCache(cache, conf)
+			zi.responseLimiter = srv.zoneResponseLimiter(zi)
+			zi.filter = zoneFilter(srv.filter, conf)
 			activeZones[conf.Name] = zi
 		} else {
 			// If the zone already exists in the map, we do not want to overwrite it as that would break the DNS query handler (since hot-reloading is supported)
@@ -123,7 +201,7 @@ func (srv *Server) populateConfig() error {
 			var err error
 			zi, err = NewZoneInstance(conf.Name, *conf, srv.promMetrics)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if zi.Tailscale != nil {
 				util.Logger.Debug().Str("zone", conf.Name).Msg("Enabling Tailscale")
@@ -131,26 +209,54 @@ func (srv *Server) populateConfig() error {
 			}
 			// If the user wants to enable recursive resolution, check that it's compiled into the running binary
 			if zi.RecursionEnabled && !IsRecursiveResolutionEnabled() {
-				return util.RecursionStubError
+				return nil, util.RecursionStubError
 			}
+			zi.zoneLookup = lookup
+			zi.reverseLookup = reverse
+			zi.cache = zoneCache(cache, conf)
+			zi.responseLimiter = srv.zoneResponseLimiter(zi)
+			zi.filter = zoneFilter(srv.filter, conf)
 			activeZones[conf.Name] = zi
-			srv.dnsServeMux.Handle(zi.Name, zi)
 		}
 	}
 
-	prevZones := slicesx.MapKeys(srv.zones)
-	currZones := slicesx.MapKeys(activeZones)
-	for _, z := range prevZones {
-		if slices.Index(currZones, z) == -1 {
-			srv.dnsServeMux.HandleRemove(z)
-			srv.zones[z].Stop()
-			util.Logger.Info().Msgf("Removing zone %s", z)
+	return activeZones, nil
+}
+
+// lookupZone finds the most specific zone of the default view that serves a name
+func (srv *Server) lookupZone(name string) (*ZoneInstance, bool) {
+	srv.configMu.RLock()
+	defer srv.configMu.RUnlock()
+	return findZone(srv.zones, name)
+}
+
+// reverseLookup collects the forward names in every zone of the default view that point at an address, for
+// automatic PTR records
+func (srv *Server) reverseLookup(addr netip.Addr) []AddressOwner {
+	srv.configMu.RLock()
+	defer srv.configMu.RUnlock()
+	return addressOwners(srv.zones, addr)
+}
+
+// findZone finds the most specific zone that serves a name, mirroring how dns.ServeMux matches zones to queries
+func findZone(zones map[string]*ZoneInstance, name string) (*ZoneInstance, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if zi, ok := zones[name[off:]]; ok {
+			return zi, true
 		}
 	}
+	zi, ok := zones["."]
+	return zi, ok
+}
 
-	srv.zones = activeZones
-
-	return nil
+// addressOwners collects the forward names in a set of zones that point at an address
+func addressOwners(zones map[string]*ZoneInstance, addr netip.Addr) []AddressOwner {
+	var owners []AddressOwner
+	for _, zi := range zones {
+		owners = append(owners, zi.AddressOwners(addr)...)
+	}
+	return owners
 }
 
 func (srv *Server) setupPrometheusMetrics(registry *prometheus.Registry) {
@@ -190,8 +296,22 @@ func (srv *Server) Run() {
 
 	// Run the things!
 	go srv.RunHTTPControlSocket(runCtx)
-	go srv.servePlainDNS(runCtx, &srv.dnsWg, "udp")
-	go srv.servePlainDNS(runCtx, &srv.dnsWg, "tcp")
+	srv.configMu.Lock()
+	srv.runCtx = runCtx
+	for _, l := range srv.listeners {
+		srv.startListener(l)
+	}
+	srv.filter.Start()
+	srv.configMu.Unlock()
+	if dot := srv.config.DNSConfig.DoT; dot != nil && dot.Enabled {
+		srv.serveTLSDNS(runCtx, &srv.dnsWg)
+	}
+	if doh := srv.config.DNSConfig.DoH; doh != nil && doh.Enabled {
+		srv.serveHTTPSDNS(runCtx, &srv.dnsWg)
+	}
+	if doq := srv.config.DNSConfig.DoQ; doq != nil && doq.Enabled {
+		srv.serveQUICDNS(runCtx, &srv.dnsWg)
+	}
 
 	// Await stop signals
 	<-runCtx.Done()
@@ -221,15 +341,20 @@ func (srv *Server) Run() {
 // || Actual DNS Server Stuff ||
 // ||=========================||
 
-func (srv *Server) servePlainDNS(ctx context.Context, wg *sync.WaitGroup, net string) {
-	addr := fmt.Sprintf(":%d", srv.config.DNSConfig.Port)
+func (srv *Server) servePlainDNS(ctx context.Context, wg *sync.WaitGroup, net string, addr string, handler dns.Handler) {
 	ns := &dns.Server{
 		Addr:          addr,
 		Net:           net,
-		Handler:       srv.dnsServeMux,
+		Handler:       handler,
 		MaxTCPQueries: 2048,
 		ReusePort:     true,
 	}
+	srv.runDNSServer(ctx, wg, ns)
+}
+
+// runDNSServer starts a DNS server and shuts it down once the context is cancelled
+func (srv *Server) runDNSServer(ctx context.Context, wg *sync.WaitGroup, ns *dns.Server) {
+	net, addr := ns.Net, ns.Addr
 
 	wg.Add(1)
 	go func() {
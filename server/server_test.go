@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/henrikvtcodes/tungsten/config"
+	"github.com/henrikvtcodes/tungsten/util"
+	"github.com/miekg/dns"
+)
+
+// loadTestServer loads a YAML config into a server without starting any listeners
+func loadTestServer(t *testing.T, conf string) *Server {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dnsConf, err := config.LoadFromPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{
+		config:      &config.WrappedServerConfig{DNSConfig: dnsConf},
+		zones:       make(map[string]*ZoneInstance),
+		dnsServeMux: dns.NewServeMux(),
+		globalZones: make(map[string]struct{}),
+		listeners:   make(map[string]*dnsListener),
+		certs:       new(certificateStore),
+		promMetrics: util.NewDNSMetrics(),
+	}
+	if err := srv.populateConfig(); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// testWriter captures the reply to a query that arrived over UDP from a client address
+type testWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+}
+
+func (w *testWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *testWriter) WriteMsg(msg *dns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+// exchange serves a query from a client address and returns the reply
+func exchange(t *testing.T, h dns.Handler, req *dns.Msg, client string) *dns.Msg {
+	t.Helper()
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}}
+	h.ServeDNS(w, req)
+	if w.msg == nil {
+		t.Fatal("no reply was written")
+	}
+	return w.msg
+}
+
+// rrStrings renders records without their TTL and class (ie "www.example.com. A 192.0.2.1"), for comparing sections
+func rrStrings(rrs []dns.RR) []string {
+	var out []string
+	for _, rr := range rrs {
+		fields := strings.Fields(rr.String())
+		out = append(out, fields[0]+" "+strings.Join(fields[3:], " "))
+	}
+	return out
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/base64"
+	"net"
+
+	"github.com/henrikvtcodes/tungsten/config"
+	"github.com/henrikvtcodes/tungsten/util"
+	"github.com/miekg/dns"
+)
+
+// svcbParams converts the typed config fields of an SVCB/HTTPS record into SvcParams. The fields are validated when the
+// config is loaded, so anything that fails to parse here is skipped.
+func svcbParams(rec config.SVCBRecord) []dns.SVCBKeyValue {
+	var ipv4Hint, ipv6Hint []net.IP
+	for _, addr := range rec.IPv4Hint {
+		if ip := net.ParseIP(addr); ip != nil {
+			ipv4Hint = append(ipv4Hint, ip.To4())
+		}
+	}
+	for _, addr := range rec.IPv6Hint {
+		if ip := net.ParseIP(addr); ip != nil {
+			ipv6Hint = append(ipv6Hint, ip)
+		}
+	}
+	ech, _ := base64.StdEncoding.DecodeString(rec.ECH)
+
+	return util.SVCBParams(rec.ALPN, rec.Port, ipv4Hint, ech, ipv6Hint)
+}
+
+// deriveHTTPS builds an HTTPS record pointing at the owner name itself, with address hints taken from its static A/AAAA
+// records. The lowest TTL of those records is used.
+func (zi *ZoneInstance) deriveHTTPS(name string, key string) (dns.RR, bool) {
+	if zi.AutoHTTPS == nil || !zi.AutoHTTPS.Enabled {
+		return nil, false
+	}
+
+	aRecs, aOk := zi.StaticRecords.A[key]
+	aaaaRecs, aaaaOk := zi.StaticRecords.AAAA[key]
+	if !aOk && !aaaaOk {
+		return nil, false
+	}
+
+	var (
+		ipv4Hint, ipv6Hint []net.IP
+		ttl                uint32
+		ttlSet             = false
+	)
+	for _, rec := range aRecs {
+		ipv4Hint = append(ipv4Hint, net.ParseIP(rec.Address).To4())
+		if !ttlSet || rec.TTL < ttl {
+			ttl, ttlSet = rec.TTL, true
+		}
+	}
+	for _, rec := range aaaaRecs {
+		ipv6Hint = append(ipv6Hint, net.ParseIP(rec.Address))
+		if !ttlSet || rec.TTL < ttl {
+			ttl, ttlSet = rec.TTL, true
+		}
+	}
+
+	zi.qLog.Debug().Msgf("Deriving HTTPS record from address records (%s)", name)
+	params := util.SVCBParams(zi.AutoHTTPS.ALPN, 0, ipv4Hint, nil, ipv6Hint)
+	return util.HTTPSRecord(name, 1, ".", params, ttl), true
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSVCBRecords(t *testing.T) {
+	srv := loadTestServer(t, `
+zones:
+  - name: example.com.
+    forwardEnabled: false
+    autoHttps:
+      enabled: true
+    records:
+      A:
+        www: [{address: 192.0.2.1}, {address: 192.0.2.2}]
+        v4: [{address: 192.0.2.3}]
+      AAAA:
+        www: [{address: "2001:db8::1"}]
+      HTTPS:
+        "@": [{priority: 0, target: www.example.com}]
+        svc:
+          - priority: 1
+            alpn: [h3, h2]
+            port: 8443
+            ipv4hint: [192.0.2.10]
+            ipv6hint: ["2001:db8::10"]
+            ech: AEX+DQ==
+          - {priority: 2, target: backup.example.net.}
+      SVCB:
+        _dns:
+          - {priority: 1, target: dns.example.com., alpn: [dot], port: 853}
+`)
+	zone := srv.zones["example.com."]
+
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		answer []string
+	}{
+		{
+			name:   "alias mode",
+			qname:  "example.com.",
+			qtype:  dns.TypeHTTPS,
+			answer: []string{"example.com. HTTPS 0 www.example.com."},
+		},
+		{
+			name:  "service mode with params",
+			qname: "svc.example.com.",
+			qtype: dns.TypeHTTPS,
+			answer: []string{
+				`svc.example.com. HTTPS 1 . alpn="h3,h2" port="8443" ipv4hint="192.0.2.10" ech="AEX+DQ==" ipv6hint="2001:db8::10"`,
+				"svc.example.com. HTTPS 2 backup.example.net.",
+			},
+		},
+		{
+			name:   "svcb",
+			qname:  "_dns.example.com.",
+			qtype:  dns.TypeSVCB,
+			answer: []string{`_dns.example.com. SVCB 1 dns.example.com. alpn="dot" port="853"`},
+		},
+		{
+			name:   "derived from address records",
+			qname:  "www.example.com.",
+			qtype:  dns.TypeHTTPS,
+			answer: []string{`www.example.com. HTTPS 1 . alpn="h2,http/1.1" ipv4hint="192.0.2.1,192.0.2.2" ipv6hint="2001:db8::1"`},
+		},
+		{
+			name:   "derived from ipv4 only",
+			qname:  "v4.example.com.",
+			qtype:  dns.TypeHTTPS,
+			answer: []string{`v4.example.com. HTTPS 1 . alpn="h2,http/1.1" ipv4hint="192.0.2.3"`},
+		},
+		{
+			name:   "not derived without address records",
+			qname:  "_dns.example.com.",
+			qtype:  dns.TypeHTTPS,
+			answer: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := exchange(t, zone, new(dns.Msg).SetQuestion(tt.qname, tt.qtype), "192.0.2.10")
+			if res.Rcode != dns.RcodeSuccess {
+				t.Errorf("rcode = %s, want NOERROR", dns.RcodeToString[res.Rcode])
+			}
+			if got := rrStrings(res.Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/henrikvtcodes/tungsten/util"
+	"github.com/miekg/dns"
+)
+
+// certificateStore holds the certificate shared by all encrypted transports. Listeners read it through GetCertificate on
+// every handshake, so it can be swapped out on reload without restarting them.
+type certificateStore struct {
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// Load reads a certificate and key pair from disk and makes it the active certificate. On failure, the previous one
+// stays active.
+func (cs *certificateStore) Load(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to load TLS certificate %s", certFile), err)
+	}
+	cs.cert.Store(&cert)
+	return nil
+}
+
+func (cs *certificateStore) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := cs.cert.Load()
+	if cert == nil {
+		return nil, errors.New("no TLS certificate loaded")
+	}
+	return cert, nil
+}
+
+// TLSConfig builds a TLS config for a listener that negotiates the given ALPN protocols
+func (cs *certificateStore) TLSConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: cs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     nextProtos,
+	}
+}
+
+// populateCertificates (re)loads the certificate used by the encrypted transports, if one is configured
+func (srv *Server) populateCertificates() error {
+	tlsConf := srv.config.DNSConfig.TLS
+	if tlsConf == nil || tlsConf.CertFile == "" {
+		if srv.config.DNSConfig.DoT != nil && srv.config.DNSConfig.DoT.Enabled {
+			return errors.New("DNS-over-TLS is enabled but no TLS certificate is configured")
+		}
+		if doh := srv.config.DNSConfig.DoH; doh != nil && doh.Enabled && !doh.PlainHTTP {
+			return errors.New("DNS-over-HTTPS is enabled but no TLS certificate is configured")
+		}
+		if srv.config.DNSConfig.DoQ != nil && srv.config.DNSConfig.DoQ.Enabled {
+			return errors.New("DNS-over-QUIC is enabled but no TLS certificate is configured")
+		}
+		return nil
+	}
+
+	if err := srv.certs.Load(tlsConf.CertFile, tlsConf.KeyFile); err != nil {
+		return err
+	}
+	util.Logger.Info().Msgf("Loaded TLS certificate from %s", tlsConf.CertFile)
+	return nil
+}
+
+// serveTLSDNS runs DNS-over-TLS (RFC 7858) listeners on the server-wide bind addresses
+func (srv *Server) serveTLSDNS(ctx context.Context, wg *sync.WaitGroup) {
+	addrs, err := srv.resolveBindAddresses(srv.config.DNSConfig.Bind, srv.config.DNSConfig.DoT.Port)
+	if err != nil {
+		util.Logger.Err(err).Msg("Failed to resolve DNS-over-TLS bind addresses")
+		return
+	}
+
+	for _, addr := range addrs {
+		ns := &dns.Server{
+			Addr:          addr,
+			Net:           "tcp-tls",
+			Handler:       srv.dispatch(srv.dnsServeMux),
+			TLSConfig:     srv.certs.TLSConfig("dot"),
+			MaxTCPQueries: 2048,
+			ReusePort:     true,
+		}
+		go srv.runDNSServer(ctx, wg, ns)
+	}
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/henrikvtcodes/tungsten/config"
+	"github.com/miekg/dns"
+)
+
+const (
+	upstreamTimeout = 5 * time.Second
+	// upstreamIdleConns is how many TCP/TLS connections are kept open to each upstream between queries
+	upstreamIdleConns = 4
+)
+
+// Upstream is a forwarder server along with the clients and idle connections used to reach it
+type Upstream struct {
+	config.Upstream
+
+	client *dns.Client
+	idle   chan *dns.Conn
+	http   *http.Client
+
+	health upstreamHealth
+}
+
+func NewUpstream(raw string) (*Upstream, error) {
+	conf, err := config.ParseUpstream(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	up := &Upstream{
+		Upstream: *conf,
+		client:   &dns.Client{Net: conf.Net, Timeout: upstreamTimeout},
+		idle:     make(chan *dns.Conn, upstreamIdleConns),
+	}
+
+	tlsConf := &tls.Config{ServerName: conf.ServerName, MinVersion: tls.VersionTLS12}
+	switch conf.Net {
+	case config.UpstreamTLS:
+		up.client.TLSConfig = tlsConf
+	case config.UpstreamHTTPS:
+		// Dial the configured address rather than the URL host, so a pinned IP is honoured. Without a pin this is the
+		// server name, which still goes through the system resolver.
+		dialer := &net.Dialer{Timeout: upstreamTimeout}
+		up.http = &http.Client{
+			Timeout: upstreamTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, conf.Addr)
+				},
+				TLSClientConfig:   tlsConf,
+				ForceAttemptHTTP2: true,
+				MaxIdleConns:      upstreamIdleConns,
+				IdleConnTimeout:   90 * time.Second,
+			},
+		}
+	}
+
+	return up, nil
+}
+
+// Exchange sends a query to the upstream. Bare IP upstreams use the same transport as the client query (netType).
+func (u *Upstream) Exchange(req *dns.Msg, netType string) (*dns.Msg, time.Duration, error) {
+	switch u.Net {
+	case config.UpstreamAuto:
+		if netType != config.UpstreamUDP {
+			client := &dns.Client{Net: netType, Timeout: upstreamTimeout}
+			return client.Exchange(req, u.Addr)
+		}
+		return u.exchangeUDP(req)
+	case config.UpstreamUDP:
+		return u.exchangeUDP(req)
+	case config.UpstreamHTTPS:
+		return u.exchangeHTTPS(req)
+	default:
+		return u.exchangeConn(req)
+	}
+}
+
+// exchangeUDP sends a query over UDP, retrying over TCP if the response was truncated
+func (u *Upstream) exchangeUDP(req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	client := &dns.Client{Net: config.UpstreamUDP, Timeout: upstreamTimeout}
+	if opt := req.IsEdns0(); opt != nil {
+		client.UDPSize = opt.UDPSize()
+	}
+	res, rtt, err := client.Exchange(req, u.Addr)
+	if err != nil || !res.Truncated {
+		return res, rtt, err
+	}
+
+	tcpClient := &dns.Client{Net: config.UpstreamTCP, Timeout: upstreamTimeout}
+	tcpRes, tcpRtt, err := tcpClient.Exchange(req, u.Addr)
+	if err != nil {
+		// The truncated response is still better than nothing, the client can retry over TCP itself
+		return res, rtt, nil
+	}
+	return tcpRes, rtt + tcpRtt, nil
+}
+
+// exchangeConn sends a query over a persistent TCP or TLS connection, dialing a new one if none are idle. A reused
+// connection may have been closed by the upstream in the meantime, so failures on one are retried on a fresh connection.
+func (u *Upstream) exchangeConn(req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	for {
+		var (
+			conn   *dns.Conn
+			reused bool
+			err    error
+		)
+		select {
+		case conn = <-u.idle:
+			reused = true
+		default:
+			if conn, err = u.client.Dial(u.Addr); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		res, rtt, err := u.client.ExchangeWithConn(req, conn)
+		if err != nil {
+			_ = conn.Close()
+			if reused {
+				continue
+			}
+			return nil, rtt, err
+		}
+
+		select {
+		case u.idle <- conn:
+		default:
+			_ = conn.Close()
+		}
+		return res, rtt, nil
+	}
+}
+
+// exchangeHTTPS sends a query as a DoH POST request (RFC 8484)
+func (u *Upstream) exchangeHTTPS(req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	// DoH queries use an ID of 0 to be cache friendly, so the original is restored on the response
+	id := req.Id
+	query := req.Copy()
+	query.Id = 0
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, u.URL, bytes.NewReader(buf))
+	if err != nil {
+		return nil, 0, err
+	}
+	httpReq.Header.Set("Content-Type", dohContentType)
+	httpReq.Header.Set("Accept", dohContentType)
+
+	start := time.Now()
+	httpRes, err := u.http.Do(httpReq)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer httpRes.Body.Close()
+	rtt := time.Since(start)
+
+	if httpRes.StatusCode != http.StatusOK {
+		return nil, rtt, fmt.Errorf("upstream returned HTTP status %s", httpRes.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(httpRes.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, rtt, errors.Join(errors.New("failed to read DoH response"), err)
+	}
+
+	res := new(dns.Msg)
+	if err := res.Unpack(body); err != nil {
+		return nil, rtt, err
+	}
+	res.Id = id
+	return res, rtt, nil
+}
+
+// Close closes the idle connections to the upstream
+func (u *Upstream) Close() {
+	for {
+		select {
+		case conn := <-u.idle:
+			_ = conn.Close()
+		default:
+			if u.http != nil {
+				u.http.CloseIdleConnections()
+			}
+			return
+		}
+	}
+}
+
+// populateUpstreams parses the zone's forwarder addresses, replacing (and closing) any upstreams from a previous config
+func (zi *ZoneInstance) populateUpstreams() error {
+	var upstreams []*Upstream
+	if zi.ForwardConfig != nil {
+		for _, addr := range zi.ForwardConfig.Addresses {
+			if addr == nil {
+				continue
+			}
+			up, err := NewUpstream(*addr)
+			if err != nil {
+				return err
+			}
+			upstreams = append(upstreams, up)
+		}
+	}
+
+	// Without any upstreams, queries are simply not forwarded
+	var pool *UpstreamPool
+	if len(upstreams) == 0 {
+		zi.baseLog.Warn().Msg("Forwarding is enabled but no upstream addresses are configured")
+	} else {
+		var err error
+		pool, err = NewUpstreamPool(zi.Name, zi.ForwardConfig, upstreams, zi.promMetrics)
+		if err != nil {
+			return err
+		}
+	}
+
+	old := zi.Upstreams
+	zi.Upstreams = pool
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/henrikvtcodes/tungsten/config"
+	"github.com/henrikvtcodes/tungsten/util"
+	"github.com/henrikvtcodes/tungsten/util/bind"
+	"github.com/miekg/dns"
+)
+
+// view is a split-horizon view: its own set of zones, served only to the clients it matches. A view is rebuilt as a
+// whole on every reload (reusing its zone instances), so it never changes once it is serving queries.
+type view struct {
+	name      string
+	clients   []netip.Prefix
+	listeners map[netip.Addr]struct{}
+
+	zones map[string]*ZoneInstance
+	mux   *dns.ServeMux
+	// Each view has its own cache, since the same question may have different answers in different views
+	cache *ResponseCache
+}
+
+// populateViews builds the views from the config, reusing the zones of the previous view with the same name. It
+// returns the views along with the listener addresses they need. This must be called with configMu held.
+func (srv *Server) populateViews() ([]*view, []string, error) {
+	prevViews := make(map[string]*view)
+	for _, v := range srv.views {
+		prevViews[v.name] = v
+	}
+
+	var (
+		views []*view
+		addrs []string
+	)
+	for _, conf := range srv.config.DNSConfig.Views {
+		if conf == nil {
+			continue
+		}
+		v, err := srv.newView(conf, prevViews[conf.Name])
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load view %s: %w", conf.Name, err)
+		}
+		views = append(views, v)
+
+		if len(conf.Listeners) > 0 {
+			viewAddrs, err := srv.resolveBindAddresses(conf.Listeners, srv.config.DNSConfig.Port)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to resolve listeners for view %s: %w", conf.Name, err)
+			}
+			addrs = append(addrs, viewAddrs...)
+		}
+	}
+	return views, addrs, nil
+}
+
+// newView creates a view from its config, taking over the zones of prev if it is not nil
+func (srv *Server) newView(conf *config.ViewConfig, prev *view) (*view, error) {
+	v := &view{
+		name:      conf.Name,
+		clients:   conf.Clients,
+		listeners: make(map[netip.Addr]struct{}),
+		mux:       dns.NewServeMux(),
+		cache:     NewResponseCache(srv.config.DNSConfig.Cache),
+	}
+
+	if len(conf.Listeners) > 0 {
+		ips, err := bind.ListBindIP(conf.Listeners)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if addr, err := netip.ParseAddr(ip); err == nil {
+				v.listeners[addr.Unmap()] = struct{}{}
+			}
+		}
+	}
+
+	var prevZones map[string]*ZoneInstance
+	if prev != nil {
+		prevZones = prev.zones
+	}
+	zones, err := srv.loadZones(prevZones, conf.Zones, v.lookupZone, v.reverseLookup, v.cache)
+	if err != nil {
+		return nil, err
+	}
+	for name, zi := range zones {
+		zi.baseLog = util.Logger.With().Str("zone", name).Str("view", v.name).Logger()
+		v.mux.Handle(name, zi)
+	}
+	v.zones = zones
+
+	return v, nil
+}
+
+// stopRemovedViews stops the zones that are not part of the new views, either because the view they belonged to is
+// gone or because they were removed from it. This must be called with configMu held.
+func (srv *Server) stopRemovedViews(views []*view) {
+	active := make(map[*ZoneInstance]struct{})
+	for _, v := range views {
+		for _, zi := range v.zones {
+			active[zi] = struct{}{}
+		}
+	}
+	for _, v := range srv.views {
+		for name, zi := range v.zones {
+			if _, ok := active[zi]; !ok {
+				zi.Stop()
+				util.Logger.Info().Msgf("Removing zone %s from view %s", name, v.name)
+			}
+		}
+	}
+}
+
+// lookupZone finds the most specific zone of the view that serves a name
+func (v *view) lookupZone(name string) (*ZoneInstance, bool) {
+	return findZone(v.zones, name)
+}
+
+// reverseLookup collects the forward names in every zone of the view that point at an address
+func (v *view) reverseLookup(addr netip.Addr) []AddressOwner {
+	return addressOwners(v.zones, addr)
+}
+
+// matches reports whether a query from client that arrived on local belongs to the view
+func (v *view) matches(client netip.Addr, local netip.Addr) bool {
+	if _, ok := v.listeners[local]; ok && local.IsValid() {
+		return true
+	}
+	for _, prefix := range v.clients {
+		if prefix.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchView returns the first view that a query belongs to, or nil if it belongs to the default view
+func (srv *Server) matchView(w dns.ResponseWriter, views []*view) *view {
+	if len(views) == 0 {
+		return nil
+	}
+
+	client := addrFromNet(w.RemoteAddr())
+	local := addrFromNet(w.LocalAddr())
+	for _, v := range views {
+		if v.matches(client, local) {
+			return v
+		}
+	}
+	return nil
+}
+
+// dispatch applies the server-wide query rate limit, then picks the view a query belongs to before handing it to the
+// zones of that view. Queries that match no view go to next, which serves the default view's zones.
+func (srv *Server) dispatch(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		srv.configMu.RLock()
+		views, rl := srv.views, srv.rateLimiter
+		srv.configMu.RUnlock()
+
+		if !limitQuery(rl, w, req, "", srv.promMetrics) {
+			return
+		}
+		if v := srv.matchView(w, views); v != nil {
+			v.mux.ServeDNS(w, req)
+			return
+		}
+		next.ServeDNS(w, req)
+	})
+}
@@ -4,12 +4,13 @@ import (
 	"fmt"
 	"github.com/henrikvtcodes/tungsten/config"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/henrikvtcodes/tungsten/util"
-	"github.com/henrikvtcodes/tungsten/util/roundrobin"
 	"github.com/henrikvtcodes/tungsten/util/tailscale"
 	"github.com/miekg/dns"
 	"github.com/rs/zerolog"
@@ -19,11 +20,17 @@ type ZoneInstance struct {
 	Name string
 
 	StaticRecords *config.RecordsCollection
-
-	ForwardConfig      *config.ForwardConfig
-	Forward            bool
-	dnsClient          *dns.Client
-	UpstreamRoundRobin *roundrobin.RoundRobin[string]
+	names         map[string]struct{}
+	cuts          map[string]struct{}
+	soa           *config.SOARecord
+	aliasMu       sync.Mutex
+	aliasCache    map[aliasCacheKey]aliasCacheEntry
+
+	ForwardConfig *config.ForwardConfig
+	Forward       bool
+	dnsClient     *dns.Client
+	Upstreams     *UpstreamPool
+	ednsOptions   map[uint16]struct{}
 
 	RecursionEnabled bool
 	recursor         *RecursorWrapper
@@ -31,6 +38,29 @@ type ZoneInstance struct {
 	Tailscale *config.TailscaleZoneConfig
 	TSClient  *tailscale.Tailscale
 
+	Bind config.StringList
+
+	QueryACL     *config.ACLConfig
+	RecursionACL *config.ACLConfig
+	// TrustedECSClients may pick subnet-scoped records with their EDNS Client Subnet option
+	TrustedECSClients []netip.Prefix
+	// rateLimiter holds the zone's own limits, if any. responseLimiter is used for RRL, and is either the zone's own
+	// limiter or the server-wide one.
+	rateLimiter     *RateLimiter
+	responseLimiter *RateLimiter
+
+	AutoPTR       bool
+	AutoHTTPS     *config.AutoHTTPSConfig
+	addresses     map[netip.Addr][]AddressOwner
+	reverseLookup ReverseLookup
+
+	// zoneLookup is used to chase CNAMEs into other local zones
+	zoneLookup ZoneLookup
+	// cache is the server-wide response cache, or nil if disabled for this zone
+	cache *ResponseCache
+	// filter holds the server-wide blocklists, or nil if disabled for this zone
+	filter *Filter
+
 	baseLog     zerolog.Logger
 	qLog        zerolog.Logger
 	promMetrics *util.DNSMetrics
@@ -54,11 +84,18 @@ func NewZoneInstance(name string, zone config.ZoneConfig, metrics *util.DNSMetri
 
 // Initialize takes in a zone configOld and handles updating/populating the struct. It is called both when creating a new ZoneInstance and when reloading configuration
 func (zi *ZoneInstance) Initialize(zone config.ZoneConfig) error {
-	zi.StaticRecords = zone.Records
+	zi.StaticRecords = zi.expandServices(zone.Records, zone.Services)
 	zi.ForwardConfig = zone.ForwardConfig
 	zi.Forward = zone.ForwardEnabled
 	zi.Tailscale = zone.Tailscale
 	zi.RecursionEnabled = zone.RecursionEnabled
+	zi.AutoPTR = zone.AutoPTR
+	zi.AutoHTTPS = zone.AutoHTTPS
+	zi.Bind = zone.Bind
+	zi.QueryACL = zone.QueryACL
+	zi.RecursionACL = zone.RecursionACL
+	zi.TrustedECSClients = zone.TrustedECSClients
+	zi.rateLimiter = NewRateLimiter(zone.RateLimit)
 
 	err := zi.Populate()
 	if err != nil {
@@ -79,8 +116,25 @@ func (zi *ZoneInstance) Initialize(zone config.ZoneConfig) error {
 func (zi *ZoneInstance) Populate() error {
 	// Validate the forward config
 	if zi.Forward {
-		// Evenly distribute query load across forwarder servers
-		zi.UpstreamRoundRobin, _ = roundrobin.New(zi.ForwardConfig.Addresses...)
+		if err := zi.populateUpstreams(); err != nil {
+			return err
+		}
+		if err := zi.populateEDNSOptions(); err != nil {
+			return err
+		}
+	}
+
+	// ALIAS targets may have changed, so start over with an empty cache
+	zi.aliasMu.Lock()
+	zi.aliasCache = make(map[aliasCacheKey]aliasCacheEntry)
+	zi.aliasMu.Unlock()
+
+	// Index the static record names so negative answers can be given authoritatively
+	zi.buildNameIndex()
+	zi.buildDelegations()
+	zi.buildAddressIndex()
+	if err := zi.populateSOA(); err != nil {
+		return err
 	}
 
 	return nil
@@ -98,10 +152,41 @@ func (zi *ZoneInstance) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		responder = "fail"
 	)
 
-	if msg, ok := zi.HandleRecords(question); ok {
+	if !limitQuery(zi.rateLimiter, w, req, zi.Name, zi.promMetrics) {
+		return
+	}
+
+	// ACLs go by the source address, since the client subnet option can be set to anything
+	source := addrFromNet(w.RemoteAddr())
+	if !zi.QueryACL.Allows(source) {
+		zi.refuse(w, req, "query")
+		return
+	}
+
+	client, fromSubnet := clientAddr(req, w.RemoteAddr(), zi.TrustedECSClients)
+	// The scope of a negative answer from the static records, which can depend on the client like a positive one
+	var negativeScope uint8
+	if msg, ok := zi.HandleReferral(question, client); ok {
 		res = msg
 		found = true
-		responder = "records"
+		responder = "referral"
+	}
+	if !found {
+		msg, ok := zi.HandleRecords(question, client, nil)
+		if ok {
+			res = msg
+			found = true
+			responder = "records"
+		} else {
+			negativeScope = subnetScope(msg)
+		}
+	}
+	if zi.AutoPTR && !found {
+		if msg, ok := zi.HandleAutoPTR(question); ok {
+			res = msg
+			found = true
+			responder = "autoptr"
+		}
 	}
 	if zi.Tailscale != nil && !found {
 		if msg, ok := zi.HandleTailscale(question); ok {
@@ -110,9 +195,45 @@ func (zi *ZoneInstance) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 			responder = "tailscale"
 		}
 	}
+	if found {
+		zi.ChaseCname(question, res, client, nil)
+	}
+	// Local answers only depend on the client subnet if it was trusted to pick records by, otherwise its scope is 0
+	if !fromSubnet {
+		negativeScope = 0
+		if found && subnetScope(res) > 0 {
+			res = withSubnet(res, nil)
+		}
+	}
 	reqNet := w.LocalAddr().Network()
+	// The query as it is sent upstream, which also keys the cache since answers may depend on the client subnet
+	fwdReq := zi.applyECS(req, w.RemoteAddr())
+	if (zi.Forward || zi.RecursionEnabled) && !found && !zi.RecursionACL.Allows(source) {
+		zi.refuse(w, req, "recursion")
+		return
+	}
+	// Blocklists only apply to names that would otherwise be looked up elsewhere, so local records always win
+	if zi.filter != nil && (zi.Forward || zi.RecursionEnabled) && !found {
+		if msg, ok := zi.filter.Handle(question); ok {
+			zi.qLog.Info().Msgf("Blocked by filter (%s)", question.Name)
+			res = msg
+			found = true
+			responder = "filter"
+		}
+	}
+	if zi.cache != nil && (zi.Forward || zi.RecursionEnabled) && !found {
+		msg, ok := zi.cache.Get(fwdReq)
+		zi.promMetrics.CountCacheLookup(zi.Name, ok)
+		if ok {
+			zi.qLog.Debug().Msgf("Answered from cache (%s)", question.Name)
+			res = msg
+			found = true
+			responder = "cache"
+			zi.prefetch(fwdReq, reqNet)
+		}
+	}
 	if zi.Forward && zi.ForwardConfig != nil && !found {
-		if msg, ok := zi.HandleForward(req, reqNet); ok {
+		if msg, ok := zi.HandleForward(fwdReq, reqNet); ok {
 			res = msg
 			found = true
 			responder = "forward"
@@ -125,13 +246,30 @@ func (zi *ZoneInstance) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 			responder = "recursive"
 		}
 	}
+	// Forwarded responses are cached by HandleForward itself, since it also serves stale ones from the cache
+	if zi.cache != nil && responder == "recursive" {
+		zi.cache.Set(fwdReq, res, 0)
+	}
+
+	if !found && zi.IsAuthoritative() {
+		res = zi.NegativeResponse(question)
+		setSubnetScope(res, negativeScope)
+		found = true
+		responder = "records"
+	}
 
 	if !found {
 		zi.qLog.Warn().Msgf("No response found (%s)", question.Name)
-		res.SetRcode(req, dns.RcodeServerFailure)
+		res.Rcode = dns.RcodeServerFailure
 	}
 
-	res.SetReply(req)
+	finalizeReply(req, res, reqNet)
+
+	if !zi.limitResponse(w, res) {
+		zi.qLog.Debug().Str("client", w.RemoteAddr().String()).Msgf("Response dropped by rate limit (%s)", question.Name)
+		zi.promMetrics.CountQuery(zi.Name, dns.Type(question.Qtype).String(), "ratelimit")
+		return
+	}
 
 	err := w.WriteMsg(res)
 	if err != nil {
@@ -142,37 +280,157 @@ func (zi *ZoneInstance) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	zi.promMetrics.CountQuery(zi.Name, dns.Type(question.Qtype).String(), responder)
 }
 
+// refuse answers a query that was rejected by one of the zone's ACLs with REFUSED
+func (zi *ZoneInstance) refuse(w dns.ResponseWriter, req *dns.Msg, acl string) {
+	question := req.Question[0]
+	zi.qLog.Info().Str("client", w.RemoteAddr().String()).Msgf("Query refused by %s ACL (%s)", acl, question.Name)
+
+	res := new(dns.Msg)
+	res.Rcode = dns.RcodeRefused
+	finalizeReply(req, res, w.LocalAddr().Network())
+	if err := w.WriteMsg(res); err != nil {
+		zi.qLog.Error().Err(err).Msgf("Failed to write response (%s)", question.Name)
+	}
+
+	zi.promMetrics.CountRefused(zi.Name, acl)
+	zi.promMetrics.CountQuery(zi.Name, dns.Type(question.Qtype).String(), "refused")
+}
+
 // ||=====================||
 // || RESPONDER FUNCTIONS ||
 // ||=====================||
 
-// HandleRecords checks the static records configOld and answers accordingly
-func (zi *ZoneInstance) HandleRecords(q dns.Question) (*dns.Msg, bool) {
+// HandleRecords checks the static records configOld and answers accordingly. Records scoped to subnets are picked
+// based on the client address, and aliases holds the ALIAS targets already being resolved for the query.
+func (zi *ZoneInstance) HandleRecords(q dns.Question, client netip.Addr, aliases aliasChain) (*dns.Msg, bool) {
 	zi.qLog.Debug().Msgf("Handling query with Static Records (%s)", q.Name)
 	var (
 		msg     *dns.Msg
 		answers []dns.RR
 		found   = false
+		scope   uint8
 	)
-	subdomain, _ := strings.CutSuffix(q.Name, fmt.Sprintf(".%s", zi.Name))
+	if zi.StaticRecords == nil {
+		return nil, false
+	}
+	// Names at or below a zone cut belong to the child zone, so they have no data here (not even wildcards)
+	if _, ok := zi.delegated(q); ok {
+		return nil, false
+	}
+	subdomain := zi.recordKey(q.Name)
+	if key, ok := zi.wildcardKey(q.Name); ok {
+		zi.qLog.Debug().Msgf("Synthesizing answer from wildcard %s (%s)", key, q.Name)
+		subdomain = key
+	}
 
 	switch q.Qtype {
 	case dns.TypeA:
-		if recs, ok := zi.StaticRecords.A[subdomain]; ok {
+		if recs := scopeRecords(zi.StaticRecords.A[subdomain], client, &scope); len(recs) > 0 {
 			found = true
 			for _, rec := range recs {
 				answers = append(answers, util.ARecord(q.Name, net.ParseIP(rec.Address), rec.TTL))
 			}
 		}
 	case dns.TypeAAAA:
-		if recs, ok := zi.StaticRecords.AAAA[subdomain]; ok {
+		if recs := scopeRecords(zi.StaticRecords.AAAA[subdomain], client, &scope); len(recs) > 0 {
 			found = true
 			for _, rec := range recs {
 				answers = append(answers, util.AAAARecord(q.Name, net.ParseIP(rec.Address), rec.TTL))
 			}
 		}
 	case dns.TypeCNAME:
-		if recs, ok := zi.StaticRecords.CNAME[subdomain]; ok {
+		if recs := scopeRecords(zi.StaticRecords.CNAME[subdomain], client, &scope); len(recs) > 0 {
+			found = true
+			for _, rec := range recs {
+				answers = append(answers, util.CnameRecord(q.Name, rec.Target, rec.TTL))
+			}
+		}
+	case dns.TypeMX:
+		if recs := scopeRecords(zi.StaticRecords.MX[subdomain], client, &scope); len(recs) > 0 {
+			found = true
+			for _, rec := range recs {
+				answers = append(answers, util.MXRecord(q.Name, rec.Target, uint16(rec.Preference), rec.TTL))
+			}
+		}
+	case dns.TypeTXT:
+		if recs := scopeRecords(zi.StaticRecords.TXT[subdomain], client, &scope); len(recs) > 0 {
+			found = true
+			for _, rec := range recs {
+				if len(rec.Strings) > 0 {
+					answers = append(answers, util.TXTStringsRecord(q.Name, rec.Strings, rec.TTL))
+				} else {
+					answers = append(answers, util.TXTRecord(q.Name, rec.Content, rec.TTL))
+				}
+			}
+		}
+	case dns.TypeSRV:
+		if recs := scopeRecords(zi.StaticRecords.SRV[subdomain], client, &scope); len(recs) > 0 {
+			found = true
+			for _, rec := range recs {
+				answers = append(answers, util.SRVRecord(q.Name, rec.Target, rec.Priority, rec.Weight, rec.Port, rec.TTL))
+			}
+		}
+	case dns.TypeCAA:
+		if recs := scopeRecords(zi.StaticRecords.CAA[subdomain], client, &scope); len(recs) > 0 {
+			found = true
+			for _, rec := range recs {
+				answers = append(answers, util.CAARecord(q.Name, rec.Flag, rec.Tag, rec.Value, rec.TTL))
+			}
+		}
+	case dns.TypePTR:
+		if recs := scopeRecords(zi.StaticRecords.PTR[subdomain], client, &scope); len(recs) > 0 {
+			found = true
+			for _, rec := range recs {
+				answers = append(answers, util.PTRRecord(q.Name, rec.Target, rec.TTL))
+			}
+		}
+	case dns.TypeNS:
+		if recs := scopeRecords(zi.StaticRecords.NS[subdomain], client, &scope); len(recs) > 0 {
+			found = true
+			for _, rec := range recs {
+				answers = append(answers, util.NSRecord(q.Name, rec.Target, rec.TTL))
+			}
+		}
+	case dns.TypeSVCB:
+		if recs := scopeRecords(zi.StaticRecords.SVCB[subdomain], client, &scope); len(recs) > 0 {
+			found = true
+			for _, rec := range recs {
+				answers = append(answers, util.SVCBRecord(q.Name, rec.Priority, rec.Target, svcbParams(rec), rec.TTL))
+			}
+		}
+	case dns.TypeHTTPS:
+		if recs := scopeRecords(zi.StaticRecords.HTTPS[subdomain], client, &scope); len(recs) > 0 {
+			found = true
+			for _, rec := range recs {
+				answers = append(answers, util.HTTPSRecord(q.Name, rec.Priority, rec.Target, svcbParams(rec), rec.TTL))
+			}
+		} else if rr, ok := zi.deriveHTTPS(q.Name, subdomain); ok {
+			found = true
+			answers = append(answers, rr)
+		}
+	case dns.TypeSOA:
+		// The SOA record only exists at the zone apex. The generated one is only served by authoritative zones, so that
+		// forwarding zones pass the real one through from upstream.
+		if strings.EqualFold(q.Name, zi.Name) && (zi.StaticRecords.SOA != nil || zi.IsAuthoritative()) {
+			found = true
+			answers = append(answers, zi.soaRecord(q.Name, zi.soa.TTL))
+		}
+	}
+
+	if !found && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+		if recs := scopeRecords(zi.StaticRecords.ALIAS[subdomain], client, &scope); len(recs) > 0 {
+			for _, rec := range recs {
+				if rrs, ok := zi.HandleAlias(q, rec.Target, rec.TTL, aliases); ok {
+					found = true
+					answers = append(answers, rrs...)
+				}
+			}
+		}
+	}
+
+	// A name that owns a CNAME cannot own any other data, so answer with the CNAME and let ServeDNS chase it
+	if !found && q.Qtype != dns.TypeCNAME {
+		if recs := scopeRecords(zi.StaticRecords.CNAME[subdomain], client, &scope); len(recs) > 0 {
 			found = true
 			for _, rec := range recs {
 				answers = append(answers, util.CnameRecord(q.Name, rec.Target, rec.TTL))
@@ -183,11 +441,17 @@ func (zi *ZoneInstance) HandleRecords(q dns.Question) (*dns.Msg, bool) {
 	if found {
 		zi.qLog.Info().Msgf("Handled query with Static Records (%s)", q.Name)
 		msg = new(dns.Msg)
-		//msg.Authoritative, msg.RecursionAvailable = true, true
+		msg.Authoritative = true
 		msg.Answer = answers
+		setSubnetScope(msg, scope)
 		return msg, found
 	}
-	return nil, false
+	if scope > 0 {
+		// The negative answer depends on the client as well, so pass its scope on
+		msg = new(dns.Msg)
+		setSubnetScope(msg, scope)
+	}
+	return msg, false
 }
 
 // HandleTailscale checks machine names in Tailscale and responds with their IP addresses
@@ -204,7 +468,7 @@ func (zi *ZoneInstance) HandleTailscale(q dns.Question) (*dns.Msg, bool) {
 		found   = false
 	)
 
-	sub, _ := strings.CutSuffix(q.Name, zi.Name)
+	sub, _ := strings.CutSuffix(strings.ToLower(q.Name), strings.ToLower(zi.Name))
 	if m, ok := strings.CutSuffix(sub, zi.Tailscale.MachineSubdomain); ok {
 		if mEntry, ok := zi.TSClient.FindMachine(m); ok {
 			zi.qLog.Debug().Msgf("Found machine entry: %s", m)
@@ -232,8 +496,8 @@ func (zi *ZoneInstance) HandleTailscale(q dns.Question) (*dns.Msg, bool) {
 			}
 
 			switch q.Qtype {
-			case dns.TypeCNAME:
-				zi.qLog.Debug().Msgf("Answering for CNAME")
+			case dns.TypeCNAME, dns.TypeA, dns.TypeAAAA:
+				zi.qLog.Debug().Msgf("Answering with CNAME")
 				answers = util.CnameRecordList(q.Name, targetFqdns, zi.Tailscale.CnameTtl)
 			default:
 				found = false
@@ -255,56 +519,90 @@ func (zi *ZoneInstance) HandleTailscale(q dns.Question) (*dns.Msg, bool) {
 
 // HandleForward forwards queries to upstream DNS servers like 1.1.1.1, 9.9.9.9, etc
 func (zi *ZoneInstance) HandleForward(q *dns.Msg, netType string) (*dns.Msg, bool) {
+	if zi.Upstreams == nil {
+		return nil, false
+	}
 	zi.qLog.Debug().Msgf("Handling query with Forwarder (%s)", q.Question[0].Name)
-	var (
-		msg    *dns.Msg
-		client *dns.Client
-		err    error
-		rtt    time.Duration
-	)
 
 	// Create a new DNS message to send to the upstream server.
-	fwReq := new(dns.Msg)
-	fwReq.SetQuestion(q.Question[0].Name, q.Question[0].Qtype)
-	fwReq.RecursionDesired = q.RecursionDesired
-
-	// Create a new DNS client.
-	client = new(dns.Client)
-	client.Net = netType
-	client.Timeout = 5 * time.Second
-
-	// The goal here is to cycle through all the available upstreams if necessary - and in the case that they are responding
-	// properly, round-robin to distribute load across given upstream IPs
-	upstreamCount := 0
-	for upstreamCount < zi.UpstreamRoundRobin.Count() {
-		upstream := net.JoinHostPort(*zi.UpstreamRoundRobin.Next(), "53")
-
-		zi.qLog.Debug().Msgf("Attempting to forward query for %s to upstream %s", q.Question[0].Name, upstream)
-		msg, rtt, err = client.Exchange(fwReq, upstream)
-
-		if err == nil {
-			if msg != nil {
-				// Ensure the response message is valid and has at least some answers
-				// or indicates no error.
-				if msg.Rcode == dns.RcodeServerFailure || msg.Rcode == dns.RcodeFormatError {
-					zi.qLog.Warn().Msgf("Upstream %s returned an error %s for query %s", upstream, dns.RcodeToString[msg.Rcode], q.Question[0].Name)
-					continue
-				} else {
-					zi.qLog.Info().Msgf("Forwarded query for %s to %s (rtt %d ms)", q.Question[0].Name, upstream, rtt.Milliseconds())
-					return msg, true
-				}
+	fwReq := zi.forwardRequest(q)
+
+	var (
+		msg *dns.Msg
+		ok  bool
+	)
+	if zi.Upstreams.Strategy == config.StrategyParallel {
+		msg, ok = zi.forwardParallel(fwReq, netType)
+	} else {
+		// Go through the upstreams in the order picked by the strategy until one of them answers properly
+		for _, upstream := range zi.Upstreams.Order() {
+			if msg, ok = zi.forwardTo(upstream, fwReq, netType); ok {
+				break
 			}
-		} else {
-			// An error occurred during the exchange (e.g., timeout, network issue).
-			zi.qLog.Error().Err(err).Msgf("Failed to forward query for %s to upstream %s", q.Question[0].Name, upstream)
 		}
-		upstreamCount++
 	}
 
+	if ok {
+		if zi.cache != nil {
+			zi.cache.Set(q, msg, zi.staleWindow())
+		}
+		return msg, true
+	}
+	return zi.serveStale(q)
+}
+
+// forwardTo sends a query to a single upstream, keeping track of its health
+func (zi *ZoneInstance) forwardTo(upstream *Upstream, fwReq *dns.Msg, netType string) (*dns.Msg, bool) {
+	zi.qLog.Debug().Msgf("Attempting to forward query for %s to upstream %s", fwReq.Question[0].Name, upstream)
+	msg, rtt, err := upstream.Exchange(fwReq, netType)
+
+	if err != nil {
+		// An error occurred during the exchange (e.g., timeout, network issue).
+		zi.qLog.Error().Err(err).Msgf("Failed to forward query for %s to upstream %s", fwReq.Question[0].Name, upstream)
+		zi.Upstreams.RecordFailure(upstream)
+		return nil, false
+	}
+	zi.Upstreams.RecordSuccess(upstream, rtt)
+
+	// Ensure the response message indicates no error
+	if msg.Rcode == dns.RcodeServerFailure || msg.Rcode == dns.RcodeFormatError {
+		zi.qLog.Warn().Msgf("Upstream %s returned an error %s for query %s", upstream, dns.RcodeToString[msg.Rcode], fwReq.Question[0].Name)
+		return msg, false
+	}
+
+	zi.qLog.Info().Msgf("Forwarded query for %s to %s (rtt %d ms)", fwReq.Question[0].Name, upstream, rtt.Milliseconds())
+	return msg, true
+}
+
+// forwardParallel sends a query to every healthy upstream at once and returns the first proper answer
+func (zi *ZoneInstance) forwardParallel(fwReq *dns.Msg, netType string) (*dns.Msg, bool) {
+	upstreams := zi.Upstreams.Healthy()
+
+	type result struct {
+		msg *dns.Msg
+		ok  bool
+	}
+	results := make(chan result, len(upstreams))
+	for _, upstream := range upstreams {
+		go func() {
+			// Each upstream gets its own copy, since the client may modify the message (ie the ID)
+			msg, ok := zi.forwardTo(upstream, fwReq.Copy(), netType)
+			results <- result{msg, ok}
+		}()
+	}
+
+	for range upstreams {
+		if res := <-results; res.ok {
+			return res.msg, true
+		}
+	}
 	return nil, false
 }
 
 func (zi *ZoneInstance) Stop() error {
 	zi.recursor.Destroy()
+	if zi.Upstreams != nil {
+		zi.Upstreams.Close()
+	}
 	return nil
 }
@@ -1,6 +1,10 @@
 package util
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 const Namespace = "tungsten_dns"
 
@@ -15,12 +19,22 @@ func MakeSubsystemOptsFactory(Subsystem string) func(Name string, Help string) p
 	}
 }
 
+// DNSMetrics records Prometheus metrics once its collectors are registered. Its methods do nothing until then, or when
+// called on a nil *DNSMetrics.
 type DNSMetrics struct {
 	MetricsEnabled bool
 
 	totalQueriesCounter           *prometheus.CounterVec
 	queriesByRecordTypeCounter    *prometheus.CounterVec
 	queriesByResponderTypeCounter *prometheus.CounterVec
+	cacheHitsCounter              *prometheus.CounterVec
+	cacheMissesCounter            *prometheus.CounterVec
+	upstreamRttHistogram          *prometheus.HistogramVec
+	upstreamFailuresCounter       *prometheus.CounterVec
+	upstreamHealthyGauge          *prometheus.GaugeVec
+	refusedCounter                *prometheus.CounterVec
+	rateLimitDroppedCounter       *prometheus.CounterVec
+	rateLimitSlippedCounter       *prometheus.CounterVec
 }
 
 func NewDNSMetrics() *DNSMetrics {
@@ -34,15 +48,99 @@ func (dm *DNSMetrics) SetupAndRegisterCollectors(registry *prometheus.Registry)
 	dm.queriesByRecordTypeCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: PrometheusNamespace, Name: "total_queries"}, []string{"zone", "type"})
 	dm.queriesByResponderTypeCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: PrometheusNamespace, Name: "total_queries", Help: "Total number of queries"}, []string{"zone", "responder"})
 
-	registry.MustRegister(dm.totalQueriesCounter, dm.queriesByRecordTypeCounter, dm.queriesByResponderTypeCounter)
+	dm.cacheHitsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: PrometheusNamespace, Name: "cache_hits", Help: "Number of queries answered from the response cache"}, []string{"zone"})
+	dm.cacheMissesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: PrometheusNamespace, Name: "cache_misses", Help: "Number of cacheable queries not found in the response cache"}, []string{"zone"})
+
+	dm.upstreamRttHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: PrometheusNamespace, Name: "upstream_rtt_seconds", Help: "Round trip time of queries to upstream servers"}, []string{"zone", "upstream"})
+	dm.upstreamFailuresCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: PrometheusNamespace, Name: "upstream_failures", Help: "Number of failed queries and health probes to upstream servers"}, []string{"zone", "upstream"})
+	dm.upstreamHealthyGauge = prometheus.NewGaugeVec(MakeSubsystemOptsFactory("upstream")("healthy", "Whether an upstream server is currently in rotation (1) or ejected (0)"), []string{"zone", "upstream"})
+
+	dm.refusedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: PrometheusNamespace, Name: "refused_queries", Help: "Number of queries refused by an access control list"}, []string{"zone", "acl"})
+
+	dm.rateLimitDroppedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: PrometheusNamespace, Name: "rate_limit_dropped", Help: "Number of queries dropped (or refused over TCP) for exceeding a rate limit"}, []string{"zone", "limit"})
+	dm.rateLimitSlippedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: PrometheusNamespace, Name: "rate_limit_slipped", Help: "Number of rate limited responses sent as truncated ones"}, []string{"zone"})
+
+	registry.MustRegister(
+		dm.totalQueriesCounter,
+		dm.queriesByRecordTypeCounter,
+		dm.queriesByResponderTypeCounter,
+		dm.cacheHitsCounter,
+		dm.cacheMissesCounter,
+		dm.upstreamRttHistogram,
+		dm.upstreamFailuresCounter,
+		dm.upstreamHealthyGauge,
+		dm.refusedCounter,
+		dm.rateLimitDroppedCounter,
+		dm.rateLimitSlippedCounter,
+	)
 	dm.MetricsEnabled = true
 }
 
 func (dm *DNSMetrics) CountQuery(zone string, qType string, responder string) {
-	if !dm.MetricsEnabled {
+	if dm == nil || !dm.MetricsEnabled {
 		return
 	}
 	dm.totalQueriesCounter.WithLabelValues(zone).Inc()
 	dm.queriesByRecordTypeCounter.WithLabelValues(zone, qType).Inc()
 	dm.queriesByResponderTypeCounter.WithLabelValues(zone, responder).Inc()
 }
+
+func (dm *DNSMetrics) CountCacheLookup(zone string, hit bool) {
+	if dm == nil || !dm.MetricsEnabled {
+		return
+	}
+	if hit {
+		dm.cacheHitsCounter.WithLabelValues(zone).Inc()
+	} else {
+		dm.cacheMissesCounter.WithLabelValues(zone).Inc()
+	}
+}
+
+func (dm *DNSMetrics) ObserveUpstreamRtt(zone string, upstream string, rtt time.Duration) {
+	if dm == nil || !dm.MetricsEnabled {
+		return
+	}
+	dm.upstreamRttHistogram.WithLabelValues(zone, upstream).Observe(rtt.Seconds())
+}
+
+func (dm *DNSMetrics) CountUpstreamFailure(zone string, upstream string) {
+	if dm == nil || !dm.MetricsEnabled {
+		return
+	}
+	dm.upstreamFailuresCounter.WithLabelValues(zone, upstream).Inc()
+}
+
+func (dm *DNSMetrics) SetUpstreamHealthy(zone string, upstream string, healthy bool) {
+	if dm == nil || !dm.MetricsEnabled {
+		return
+	}
+	val := 0.0
+	if healthy {
+		val = 1
+	}
+	dm.upstreamHealthyGauge.WithLabelValues(zone, upstream).Set(val)
+}
+
+// CountRefused counts a query refused by the zone's query ("query") or recursion ("recursion") ACL
+func (dm *DNSMetrics) CountRefused(zone string, acl string) {
+	if dm == nil || !dm.MetricsEnabled {
+		return
+	}
+	dm.refusedCounter.WithLabelValues(zone, acl).Inc()
+}
+
+// CountRateLimitDrop counts a query dropped by the query ("query") or response ("response") rate limit. The zone is
+// empty for the server-wide query limit, which applies before a zone is picked.
+func (dm *DNSMetrics) CountRateLimitDrop(zone string, limit string) {
+	if dm == nil || !dm.MetricsEnabled {
+		return
+	}
+	dm.rateLimitDroppedCounter.WithLabelValues(zone, limit).Inc()
+}
+
+func (dm *DNSMetrics) CountRateLimitSlip(zone string) {
+	if dm == nil || !dm.MetricsEnabled {
+		return
+	}
+	dm.rateLimitSlippedCounter.WithLabelValues(zone).Inc()
+}
@@ -1,8 +1,10 @@
 package util
 
 import (
+	"fmt"
 	"github.com/miekg/dns"
 	"net"
+	"strings"
 )
 
 // ARecordList takes a slice of net.IPs and returns a slice of A RRs.
@@ -70,3 +72,169 @@ func CnameRecord(zone string, target string, ttl uint32) dns.RR {
 	r.Target = target
 	return r
 }
+
+// MXRecord takes a single mail exchange target and preference and returns an MX RR. The target is always emitted as an FQDN.
+func MXRecord(zone string, target string, preference uint16, ttl uint32) dns.RR {
+	r := new(dns.MX)
+	r.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeMX,
+		Class: dns.ClassINET, Ttl: ttl}
+	r.Mx = dns.Fqdn(target)
+	r.Preference = preference
+	return r
+}
+
+// TXTRecord takes a single string of text content and returns a TXT RR. Content longer than 255 bytes is split into
+// multiple character-strings, as required by RFC 1035.
+func TXTRecord(zone string, content string, ttl uint32) dns.RR {
+	r := new(dns.TXT)
+	r.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeTXT,
+		Class: dns.ClassINET, Ttl: ttl}
+	r.Txt = SplitTXTContent(content)
+	return r
+}
+
+// TXTStringsRecord takes a slice of strings and returns a TXT RR with each of them as a separate character-string.
+func TXTStringsRecord(zone string, txt []string, ttl uint32) dns.RR {
+	r := new(dns.TXT)
+	r.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeTXT,
+		Class: dns.ClassINET, Ttl: ttl}
+	for _, s := range txt {
+		r.Txt = append(r.Txt, SplitTXTContent(s)...)
+	}
+	return r
+}
+
+// SplitTXTContent splits raw text into character-strings of at most 255 bytes each. Backslashes are escaped afterward,
+// since miekg/dns treats TXT strings as presentation format when packing them onto the wire.
+func SplitTXTContent(content string) []string {
+	const maxLen = 255
+	var chunks []string
+	for len(content) > maxLen {
+		chunks = append(chunks, content[:maxLen])
+		content = content[maxLen:]
+	}
+	chunks = append(chunks, content)
+
+	for i, c := range chunks {
+		chunks[i] = strings.ReplaceAll(c, `\`, `\\`)
+	}
+	return chunks
+}
+
+// SRVRecord takes a single service target and its parameters and returns an SRV RR.
+func SRVRecord(zone string, target string, priority uint16, weight uint16, port uint16, ttl uint32) dns.RR {
+	r := new(dns.SRV)
+	r.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeSRV,
+		Class: dns.ClassINET, Ttl: ttl}
+	r.Target = dns.Fqdn(target)
+	r.Priority = priority
+	r.Weight = weight
+	r.Port = port
+	return r
+}
+
+// CAARecord takes a single CAA property and returns a CAA RR.
+func CAARecord(zone string, flag uint8, tag string, value string, ttl uint32) dns.RR {
+	r := new(dns.CAA)
+	r.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeCAA,
+		Class: dns.ClassINET, Ttl: ttl}
+	r.Flag = flag
+	r.Tag = tag
+	r.Value = value
+	return r
+}
+
+// PTRRecord takes a single string FQDN and returns a PTR RR.
+func PTRRecord(zone string, target string, ttl uint32) dns.RR {
+	r := new(dns.PTR)
+	r.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypePTR,
+		Class: dns.ClassINET, Ttl: ttl}
+	r.Ptr = dns.Fqdn(target)
+	return r
+}
+
+// NSRecord takes a single nameserver FQDN and returns an NS RR.
+func NSRecord(zone string, target string, ttl uint32) dns.RR {
+	r := new(dns.NS)
+	r.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeNS,
+		Class: dns.ClassINET, Ttl: ttl}
+	r.Ns = dns.Fqdn(target)
+	return r
+}
+
+// SOARecord takes the fields of a start of authority and returns an SOA RR.
+func SOARecord(zone string, ns string, mbox string, serial uint32, refresh uint32, retry uint32, expire uint32, minTtl uint32, ttl uint32) dns.RR {
+	r := new(dns.SOA)
+	r.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA,
+		Class: dns.ClassINET, Ttl: ttl}
+	r.Ns = dns.Fqdn(ns)
+	r.Mbox = dns.Fqdn(mbox)
+	r.Serial = serial
+	r.Refresh = refresh
+	r.Retry = retry
+	r.Expire = expire
+	r.Minttl = minTtl
+	return r
+}
+
+// SVCBParams builds the SvcParams for an SVCB or HTTPS RR, in the ascending key order required by RFC 9460.
+func SVCBParams(alpn []string, port uint16, ipv4Hint []net.IP, ech []byte, ipv6Hint []net.IP) []dns.SVCBKeyValue {
+	var params []dns.SVCBKeyValue
+	if len(alpn) > 0 {
+		params = append(params, &dns.SVCBAlpn{Alpn: alpn})
+	}
+	if port != 0 {
+		params = append(params, &dns.SVCBPort{Port: port})
+	}
+	if len(ipv4Hint) > 0 {
+		params = append(params, &dns.SVCBIPv4Hint{Hint: ipv4Hint})
+	}
+	if len(ech) > 0 {
+		params = append(params, &dns.SVCBECHConfig{ECH: ech})
+	}
+	if len(ipv6Hint) > 0 {
+		params = append(params, &dns.SVCBIPv6Hint{Hint: ipv6Hint})
+	}
+	return params
+}
+
+// SVCBRecord takes a priority, target and SvcParams and returns an SVCB RR.
+func SVCBRecord(zone string, priority uint16, target string, params []dns.SVCBKeyValue, ttl uint32) dns.RR {
+	r := new(dns.SVCB)
+	r.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeSVCB,
+		Class: dns.ClassINET, Ttl: ttl}
+	r.Priority = priority
+	r.Target = dns.Fqdn(target)
+	r.Value = params
+	return r
+}
+
+// HTTPSRecord takes a priority, target and SvcParams and returns an HTTPS RR.
+func HTTPSRecord(zone string, priority uint16, target string, params []dns.SVCBKeyValue, ttl uint32) dns.RR {
+	r := new(dns.HTTPS)
+	r.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeHTTPS,
+		Class: dns.ClassINET, Ttl: ttl}
+	r.Priority = priority
+	r.Target = dns.Fqdn(target)
+	r.Value = params
+	return r
+}
+
+// EscapeLabel converts raw label bytes (ie a DNS-SD instance name with spaces) into presentation format, the same way
+// miekg/dns does when it unpacks names from the wire.
+func EscapeLabel(label string) string {
+	var sb strings.Builder
+	for i := 0; i < len(label); i++ {
+		b := label[i]
+		switch {
+		case strings.IndexByte(`. '@;()"\`, b) >= 0:
+			sb.WriteByte('\\')
+			sb.WriteByte(b)
+		case b < ' ' || b > '~':
+			sb.WriteString(fmt.Sprintf("\\%03d", b))
+		default:
+			sb.WriteByte(b)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,64 @@
+package util
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ReverseZoneV4 = "in-addr.arpa."
+	ReverseZoneV6 = "ip6.arpa."
+)
+
+// IsReverseZone checks whether a zone name falls under in-addr.arpa. or ip6.arpa.
+func IsReverseZone(zone string) bool {
+	return dns.IsSubDomain(ReverseZoneV4, zone) || dns.IsSubDomain(ReverseZoneV6, zone)
+}
+
+// ParseReverseAddr turns a full reverse lookup name (ie 10.1.168.192.in-addr.arpa.) back into the address it points to.
+// Partial names that do not identify a single address are rejected.
+func ParseReverseAddr(name string) (netip.Addr, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	if rest, ok := strings.CutSuffix(name, "."+ReverseZoneV4); ok {
+		labels := strings.Split(rest, ".")
+		if len(labels) != 4 {
+			return netip.Addr{}, false
+		}
+		var addr [4]byte
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			addr[3-i] = byte(octet)
+		}
+		return netip.AddrFrom4(addr), true
+	}
+
+	if rest, ok := strings.CutSuffix(name, "."+ReverseZoneV6); ok {
+		labels := strings.Split(rest, ".")
+		if len(labels) != 32 {
+			return netip.Addr{}, false
+		}
+		var addr [16]byte
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return netip.Addr{}, false
+			}
+			pos := 31 - i
+			if pos%2 == 0 {
+				addr[pos/2] |= byte(nibble) << 4
+			} else {
+				addr[pos/2] |= byte(nibble)
+			}
+		}
+		return netip.AddrFrom16(addr), true
+	}
+
+	return netip.Addr{}, false
+}
@@ -7,6 +7,7 @@ import (
 	"context"
 	"github.com/henrikvtcodes/tungsten/util"
 	"net"
+	"slices"
 	"strings"
 	"sync"
 	tsLocal "tailscale.com/client/local"
@@ -184,3 +185,19 @@ func (t *Tailscale) FindCNameEntry(subdomain string) (*CNameEntry, bool) {
 	}
 	return nil, false
 }
+
+// FindMachinesByIP returns the hostnames of all machines that have the given address
+func (t *Tailscale) FindMachinesByIP(ip net.IP) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var names []string
+	for name, m := range t.MachineEntries {
+		for _, addr := range slices.Concat(m.ARecords, m.AAAARecords) {
+			if addr.Equal(ip) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names
+}